@@ -17,37 +17,70 @@
 package rtgo
 
 import (
-	"crypto/rand"
-	"crypto/sha1"
-	"crypto/sha256"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/chuckpreslar/emission"
 	"github.com/gorilla/securecookie"
+	"github.com/gorilla/websocket"
 	"github.com/pborman/uuid"
-	"github.com/tpjg/goriakpbc"
 )
 
+// DefaultViews is the pattern matching the templates of apps whose
+// config.json sets no views.
+const DefaultViews = "./static/views/*"
+
 type App struct {
-	Port        int
-	Cookiename  string
-	Templates   *template.Template
-	Scook       *securecookie.SecureCookie
-	Emitter     *emission.Emitter
-	Handlers    map[string]func(w http.ResponseWriter, r *http.Request)
-	Database    map[string]map[string]string
-	Routes      map[string]map[string]string
-	ConnManager map[string]*Conn
-	RoomManager map[string]*Room
-	DBManager   map[string]*Database
+	Port           int
+	Cookiename     string
+	Templates      *template.Template
+	Views          string
+	Keys           []CookieKey
+	Keyfile        string
+	Origins        []string
+	Codecs         []securecookie.Codec `json:"-"`
+	Emitter        *emission.Emitter
+	Handlers       map[string]func(w http.ResponseWriter, r *http.Request)
+	Database       map[string]map[string]string
+	Migrations     string
+	Passwords      map[string]string
+	Sessions       map[string]string
+	Roles          map[string][]string
+	Limits         map[string]map[string]string
+	Rooms          map[string]map[string]string
+	Cluster        map[string]string
+	Resume         map[string]string
+	Hasher         PasswordHasher `json:"-"`
+	Routes         map[string]map[string]string
+	Hub            *Hub   `json:"-"`
+	Broker         Broker `json:"-"`
+	DBManager      map[string]*Database
+	SessionManager *SessionManager `json:"-"`
+	Subscriptions  *Subscriptions  `json:"-"`
+	rpc            map[string]RPCHandler
+	rpcMu          sync.RWMutex
+	streamHandlers map[string]StreamHandler
+	streamMu       sync.RWMutex
+	hooks          hooks
+	joinPolicies   []joinPolicy
+	roomPolicies   map[string]JoinPolicy
+	joinMu         sync.RWMutex
+	throttle       passwordThrottle
+	node           string
+	drops          drops
 }
 
 // ReadCookieHandler reads a secure cookie with the name specified by cookname.
@@ -58,7 +91,7 @@ func (a *App) ReadCookieHandler(w http.ResponseWriter, r *http.Request, cookname
 		return nil
 	}
 	cookvalue := make(map[string]string)
-	if err := a.Scook.Decode(cookname, cookie.Value, &cookvalue); err != nil {
+	if err := securecookie.DecodeMulti(cookname, cookie.Value, &cookvalue, a.Codecs...); err != nil {
 		return nil
 	}
 	return cookvalue
@@ -66,8 +99,9 @@ func (a *App) ReadCookieHandler(w http.ResponseWriter, r *http.Request, cookname
 
 // SetCookieHandler sets a secure cookie with the name specified by cookname
 // and with a value specified by cookvalue.
+// The cookie is signed with the newest cookie key.
 func (a *App) SetCookieHandler(w http.ResponseWriter, r *http.Request, cookname string, cookvalue map[string]string) {
-	encoded, err := a.Scook.Encode(cookname, cookvalue)
+	encoded, err := securecookie.EncodeMulti(cookname, cookvalue, a.Codecs...)
 	if err != nil {
 		return
 	}
@@ -80,7 +114,8 @@ func (a *App) SetCookieHandler(w http.ResponseWriter, r *http.Request, cookname
 	return
 }
 
-// RegisterHandler handles user registration and only parses POST requests.
+// RegisterHandler handles user registration and only parses POST requests
+// carrying the session's CSRF token.
 func (a *App) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Invalid request method.", 405)
@@ -90,25 +125,27 @@ func (a *App) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(500)
 		return
 	}
+	if !a.CheckCSRF(w, r) {
+		http.Error(w, "Invalid CSRF token.", 403)
+		return
+	}
 	username := r.FormValue("username")
 	email := r.FormValue("email")
 	password := r.FormValue("password")
+	passhash, err := a.Hasher.Hash(password)
+	if err != nil {
+		log.Println("error hashing password: ", err)
+		w.WriteHeader(500)
+		return
+	}
 	for _, db := range a.DBManager {
 		if _, err := db.GetObj("users", username); err == nil {
 			continue
 		}
-		randombytes := make([]byte, 16)
-		if _, err := rand.Read(randombytes); err != nil {
-			continue
-		}
-		salt := fmt.Sprintf("%x", sha1.Sum(randombytes))
-		hashstring := []byte(fmt.Sprintf("%s%s%s%s", username, email, password, salt))
-		passhash := fmt.Sprintf("%x", sha256.Sum256(hashstring))
 		obj := map[string]interface{}{
 			"username": username,
 			"passhash": passhash,
 			"email":    email,
-			"salt":     salt,
 			"role": map[string]interface{}{
 				"privilege": "user",
 				"bitmask":   0,
@@ -117,17 +154,20 @@ func (a *App) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		if err := db.InsertObj("users", username, obj); err != nil {
 			continue
 		}
-		a.SetCookieHandler(w, r, a.Cookiename, map[string]string{
-			"username":  username,
-			"privilege": "user",
-		})
+		if _, err := a.StartSession(w, r, username, "user"); err != nil {
+			log.Println("error starting session: ", err)
+			break
+		}
 		w.WriteHeader(200)
 		return
 	}
 	w.WriteHeader(500)
 }
 
-// LoginHandler handles user logins and only parses POST requests.
+// LoginHandler handles user logins and only parses POST requests
+// carrying the session's CSRF token.
+// Passwords hashed with another algorithm or other parameters than
+// the configured hasher's are rehashed once the login succeeds.
 func (a *App) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Invalid request method.", 405)
@@ -137,6 +177,10 @@ func (a *App) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(500)
 		return
 	}
+	if !a.CheckCSRF(w, r) {
+		http.Error(w, "Invalid CSRF token.", 403)
+		return
+	}
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 	for _, db := range a.DBManager {
@@ -146,31 +190,70 @@ func (a *App) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		result := initial.(map[string]interface{})
 		role := result["role"].(map[string]interface{})
-		passhash := sha256.Sum256([]byte(fmt.Sprintf("%s%s%s%s", username, result["email"], password, result["salt"])))
-		if fmt.Sprintf("%x", passhash) == result["passhash"].(string) {
-			a.SetCookieHandler(w, r, a.Cookiename, map[string]string{
-				"username":  username,
-				"privilege": role["privilege"].(string),
-			})
-			w.WriteHeader(200)
-			return
+		passhash, _ := result["passhash"].(string)
+		salt, legacy := result["salt"].(string)
+		var matched bool
+		if legacy {
+			email, _ := result["email"].(string)
+			matched = subtle.ConstantTimeCompare([]byte(legacyPasshash(username, email, password, salt)), []byte(passhash)) == 1
+		} else if matched, err = VerifyPassword(password, passhash); err != nil {
+			log.Println("error verifying password: ", err)
+		}
+		if !matched {
+			continue
+		}
+		if legacy || a.Hasher.NeedsRehash(passhash) {
+			a.rehash(db, username, password, result)
 		}
+		if _, err := a.StartSession(w, r, username, role["privilege"].(string)); err != nil {
+			log.Println("error starting session: ", err)
+			break
+		}
+		w.WriteHeader(200)
+		return
 	}
 	w.WriteHeader(500)
 }
 
+// rehash replaces the password hash of a user with one produced by the
+// configured hasher, dropping the salt of legacy SHA-256 hashes.
+func (a *App) rehash(db *Database, username string, password string, user map[string]interface{}) {
+	passhash, err := a.Hasher.Hash(password)
+	if err != nil {
+		log.Println("error rehashing password: ", err)
+		return
+	}
+	user["passhash"] = passhash
+	delete(user, "salt")
+	if err := db.UpdateObj("users", username, user); err != nil {
+		log.Println("error storing rehashed password: ", err)
+	}
+}
+
 // BaseHandler handles the initial HTTP request and serves the base.html file.
+// Visitors without a valid session are given a guest session.
+// The session's CSRF token is passed to the template as .CSRF.
 func (a *App) BaseHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
-	cookvalue := map[string]string{
-		"username":  "guest",
-		"privilege": "user",
+	var err error
+	s := a.CurrentSession(w, r)
+	if s != nil {
+		if err = a.SessionManager.Touch(s); err != nil {
+			log.Println("error touching session: ", err)
+		}
+	} else if s, err = a.StartSession(w, r, "guest", "user"); err != nil {
+		log.Println("error starting session: ", err)
+	}
+	data := map[string]string{}
+	if s != nil {
+		if data["CSRF"], err = a.CSRFToken(s); err != nil {
+			log.Println("error issuing csrf token: ", err)
+		}
 	}
-	a.SetCookieHandler(w, r, a.Cookiename, cookvalue)
-	a.Templates.ExecuteTemplate(w, "base", nil)
+	a.Templates.ExecuteTemplate(w, "base", data)
 }
 
 // StaticHandler serves all static content.
@@ -179,16 +262,33 @@ func (a *App) StaticHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // SocketHandler creates a new WebSocket connection.
+// Connections from origins refused by CheckOrigin are rejected.
 func (a *App) SocketHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
-	c, err := a.NewConnection(w, r)
+	if !a.CheckOrigin(r) {
+		http.Error(w, "Origin not allowed", 403)
+		return
+	}
+	socket, session, err := a.upgrade(w, r)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	if token := r.URL.Query().Get("resume"); token != "" {
+		if c, ok := a.Hub.claim(token, session); ok {
+			if !c.resume(socket) {
+				return
+			}
+			go c.WritePump()
+			c.ReadPump()
+			return
+		}
+	}
+	c := a.newConn(socket, session, r.URL.Path)
+	c.Send(c.resumeMessage(false))
 	go c.WritePump()
 	c.Join("root")
 	c.ReadPump()
@@ -230,89 +330,160 @@ func (a *App) FindRoute(path string) map[string]string {
 }
 
 // NewConnection upgrades an icoming HTTP request, creates a new WebSocket
-// connection, and adds it to ConnManager.
+// connection, and adds it to the hub.
+// The connection's codec is the one registered for the subprotocol
+// negotiated during the upgrade, and its limits are those of the
+// request path and the session's role.
+// The upgrade fails for origins refused by CheckOrigin.
 // It returns the new connection.
 func (a *App) NewConnection(w http.ResponseWriter, r *http.Request) (*Conn, error) {
-	cookie := a.ReadCookieHandler(w, r, a.Cookiename)
-	socket, err := upgrader.Upgrade(w, r, nil)
+	socket, session, err := a.upgrade(w, r)
 	if err != nil {
 		return nil, err
 	}
+	return a.newConn(socket, session, r.URL.Path), nil
+}
+
+// upgrade upgrades an incoming HTTP request to a WebSocket connection.
+// It returns the socket, the current session if any, or an error.
+func (a *App) upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, *Session, error) {
+	session := a.CurrentSession(w, r)
+	u := upgrader
+	u.Subprotocols = Subprotocols()
+	u.CheckOrigin = a.CheckOrigin
+	socket, err := u.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return socket, session, nil
+}
+
+// newConn creates a connection for socket opened on path, issues it a
+// resume token and adds it to the hub.
+// It returns the new connection.
+func (a *App) newConn(socket *websocket.Conn, session *Session, path string) *Conn {
 	c := &Conn{
-		app:       a,
-		socket:    socket,
-		id:        uuid.New(),
-		send:      make(chan []byte, 256),
-		rooms:     make(map[string]*Room),
-		privilege: cookie["privilege"],
-	}
-	a.ConnManager[c.id] = c
-	return c, nil
+		app:     a,
+		socket:  socket,
+		quit:    make(chan struct{}),
+		written: make(chan struct{}),
+		live:    true,
+		id:      uuid.New(),
+		addr:    remoteHost(socket.RemoteAddr()),
+		codec:   codecFor(socket.Subprotocol()),
+		rooms:   make(map[string]*Room),
+		streams: newStreams(),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if session != nil {
+		c.session = session.ID
+		c.username = session.Username
+		c.privilege = session.Privilege
+	}
+	c.limits = a.ConnLimits(path, c.privilege)
+	c.out = newOutbox(c.limits.SendBuffer, c.limits.Overflow)
+	a.Hub.AddConn(c)
+	a.Hub.issueToken(c)
+	return c
 }
 
 // NewRoom will create a new room with the specified name,
-// start it, and add it to RoomManager.
-// It returns the new room.
+// start it, and add it to the hub, unless the hub already runs it.
+// It returns the room.
 func (a *App) NewRoom(name string) *Room {
-	r := &Room{
-		app:     a,
-		name:    name,
-		members: make(map[*Conn]bool),
-		stop:    make(chan bool),
-		join:    make(chan *Conn),
-		leave:   make(chan *Conn),
-		send:    make(chan []byte, 256),
-	}
-	go r.Start()
-	a.RoomManager[name] = r
-	return r
+	return a.Hub.OpenRoom(name)
 }
 
-// NewDatabase creates a new database, adds it to DBManager, and starts it.
+// NewDatabase creates a new database using the store registered under name,
+// adds it to DBManager, and starts it.
 // It returns the new database.
 func (a *App) NewDatabase(name string, params map[string]string) *Database {
-	var dsn string
-	var create string
-	switch name {
-	case "riak":
-		dsn = fmt.Sprintf("%s:%s", params["host"], params["port"])
-		create = ""
-	case "postgres":
-		dsn = fmt.Sprintf("dbname=%s user=%s password=%s host=%s sslmode=%s fallback_application_name=%s connect_timeout=%s sslcert=%s sslkey=%s sslrootcert=%s", params["dbname"], params["user"], params["password"], params["host"], params["sslmode"], params["fallback_application_name"], params["connect_timeout"], params["sslcert"], params["sslkey"], params["sslrootcert"])
-		create = "CREATE TABLE IF NOT EXISTS %s (hash VARCHAR(255) NOT NULL UNIQUE PRIMARY KEY, data BYTEA)"
-	case "mysql":
-		dsn = fmt.Sprintf("%s:%s@%s/%s?allowAllFiles=%s&allowOldPasswords=%s&charset=%s&collation=%s&clientFoundRows=%s&loc=%s&parseTime=%s&strict=%s&timeout=%s&tls=%s", params["user"], params["password"], params["host"], params["dbname"], params["allowAllFiles"], params["allowOldPasswords"], params["charset"], params["collation"], params["clientFoundRows"], params["loc"], params["parseTime"], params["strict"], params["timeout"], params["tls"])
-		create = "CREATE TABLE IF NOT EXISTS %s (hash VARCHAR(255) NOT NULL UNIQUE PRIMARY KEY, data LONGBLOB)"
-	case "sqlite3":
-		dsn = fmt.Sprintf("%s", params["file"])
-		create = "CREATE TABLE IF NOT EXISTS %s (hash VARCHAR(255) NOT NULL UNIQUE PRIMARY KEY, data BLOB)"
+	db, err := a.openDatabase(name, params)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+// openDatabase creates a new database using the store registered under name,
+// adds it to DBManager, and starts it.
+// It returns the new database or an error.
+func (a *App) openDatabase(name string, params map[string]string) (*Database, error) {
+	store, err := OpenStore(name, params)
+	if err != nil {
+		return nil, err
 	}
 	db := &Database{
-		app:     a,
-		name:    name,
-		buckets: make(map[string]*riak.Bucket),
-		params:  params,
-		dsn:     dsn,
-		create:  create,
+		app:    a,
+		name:   name,
+		params: params,
+		store:  store,
+	}
+	if err := store.Start(db.tables()); err != nil {
+		return nil, err
 	}
 	a.DBManager[name] = db
-	db.Start()
-	return db
+	return db, nil
 }
 
 // Parse parses a JSON file and assigns the values to app.
+// It exits if the file cannot be read or is invalid; see Configure.
 func (a *App) Parse(filepath string) {
 	file, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		log.Fatal("Could not parse config.json: ", err)
 	}
-	if err := json.Unmarshal(file, a); err != nil {
+	if err := a.Configure(file); err != nil {
 		log.Fatal("Error parsing config.json: ", err)
 	}
-	hashKey := securecookie.GenerateRandomKey(16)
-	blockKey := securecookie.GenerateRandomKey(16)
-	a.Scook = securecookie.New(hashKey, blockKey)
-	a.Templates = template.Must(template.ParseGlob("./static/views/*"))
+}
+
+// Configure assigns the values of a JSON document laid out as config.json
+// to app, and parses the templates matched by its views pattern.
+// Cookies are signed with the keys in the key file, newest first,
+// followed by the keys listed in the document.
+// It returns an error if the document is invalid.
+func (a *App) Configure(config []byte) error {
+	if err := json.Unmarshal(config, a); err != nil {
+		return err
+	}
+	hasher, err := NewPasswordHasher(a.Passwords)
+	if err != nil {
+		return err
+	}
+	a.Hasher = hasher
+	for _, check := range []func() error{a.checkLimits, a.checkRooms, a.checkCluster, a.checkResume} {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	keys := a.Keys
+	if a.Keyfile != "" {
+		filekeys, err := ReadKeyFile(a.Keyfile)
+		if err != nil {
+			return fmt.Errorf("could not read the key file: %v", err)
+		}
+		keys = append(filekeys, keys...)
+	}
+	if len(keys) == 0 {
+		log.Println("No cookie keys configured; sessions will not survive a restart.")
+		key, err := GenerateCookieKey()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if a.Codecs, err = NewCodecs(keys); err != nil {
+		return fmt.Errorf("invalid cookie keys: %v", err)
+	}
+	views := a.Views
+	if views == "" {
+		views = DefaultViews
+	}
+	if a.Templates, err = template.ParseGlob(views); err != nil {
+		return fmt.Errorf("views: %v", err)
+	}
+	return nil
 }
 
 // AddHandler adds a handler to the web server.
@@ -322,32 +493,131 @@ func (a *App) AddHandler(route string, handler func(w http.ResponseWriter, r *ht
 	}
 }
 
-// Start starts the app.
-func (a *App) Start() {
+// Open creates and starts every database in the database block of config.json,
+// then the session manager and the broker.
+// It exits if any of them fails; see Init.
+func (a *App) Open() {
+	if err := a.Init(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Init creates and starts every database in the database block of config.json,
+// then the session manager and the broker.
+// If a migrations directory is configured, the pending migrations
+// of every SQL database are applied.
+// It returns an error if any of them fails.
+func (a *App) Init() error {
 	for dbase, params := range a.Database {
-		a.NewDatabase(dbase, params)
+		db, err := a.openDatabase(dbase, params)
+		if err != nil {
+			return err
+		}
+		if a.Migrations == "" {
+			continue
+		}
+		if _, ok := db.Store().(SQLBackend); !ok {
+			continue
+		}
+		done, err := db.MigrateUp(a.Migrations)
+		if err != nil {
+			return err
+		}
+		for _, m := range done {
+			log.Printf("applied migration %d_%s to %s", m.Version, m.Name, dbase)
+		}
+	}
+	if err := a.openSessions(); err != nil {
+		return err
 	}
-	http.HandleFunc("/", a.BaseHandler)
-	http.HandleFunc("/login", a.LoginHandler)
-	http.HandleFunc("/register", a.RegisterHandler)
-	http.HandleFunc("/ws", a.SocketHandler)
-	http.HandleFunc("/static/", a.StaticHandler)
+	if err := a.openBroker(); err != nil {
+		return fmt.Errorf("could not open the broker: %v", err)
+	}
+	return nil
+}
+
+// Handler returns an http.Handler serving the built-in routes
+// and every handler added with AddHandler.
+func (a *App) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", a.BaseHandler)
+	mux.HandleFunc("/login", a.LoginHandler)
+	mux.HandleFunc("/register", a.RegisterHandler)
+	mux.HandleFunc("/logout", a.LogoutHandler)
+	mux.HandleFunc("/ws", a.SocketHandler)
+	mux.HandleFunc("/static/", a.StaticHandler)
 	for route, handler := range a.Handlers {
-		http.HandleFunc(route, handler)
+		mux.HandleFunc(route, handler)
+	}
+	return mux
+}
+
+// Stop stops purging sessions and stops every room and database, giving
+// stores a chance to flush their state, and closes the broker.
+func (a *App) Stop() {
+	if a.SessionManager != nil {
+		a.SessionManager.Stop()
+	}
+	for _, room := range a.Hub.Rooms() {
+		room.Stop()
+	}
+	if err := a.Broker.Close(); err != nil {
+		log.Println("error closing broker:", err)
+	}
+	for name, db := range a.DBManager {
+		if err := db.Stop(); err != nil {
+			log.Println("error stopping database", name+":", err)
+		}
 	}
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", a.Port), nil))
 }
 
-// NewApp parses a config.json file, instantiates the databases,
-// and starts the web server.
+// Start starts the app.
+// The app is stopped when the process receives SIGINT or SIGTERM.
+func (a *App) Start() {
+	a.Open()
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		a.Stop()
+		os.Exit(0)
+	}()
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", a.Port), a.Handler()))
+}
+
+// NewApp creates an app configured by the config.json file of the working
+// directory. It exits if the file cannot be read or is invalid.
+// It returns the new app.
 func NewApp() *App {
+	app := newApp()
+	app.Parse("./config.json")
+	return app
+}
+
+// NewAppWithConfig creates an app configured by config, a JSON document
+// laid out as config.json. Unlike NewApp, it reports an invalid config
+// instead of exiting, so that apps can be built in tests; Init then opens
+// their databases without exiting either.
+// It returns the new app or an error.
+func NewAppWithConfig(config []byte) (*App, error) {
+	app := newApp()
+	if err := app.Configure(config); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// newApp creates an app that is not configured yet.
+// It returns the new app.
+func newApp() *App {
 	app := &App{
-		Emitter:     emission.NewEmitter(),
-		Handlers:    make(map[string]func(w http.ResponseWriter, r *http.Request)),
-		ConnManager: make(map[string]*Conn),
-		RoomManager: make(map[string]*Room),
-		DBManager:   make(map[string]*Database),
+		Emitter:       emission.NewEmitter(),
+		Handlers:      make(map[string]func(w http.ResponseWriter, r *http.Request)),
+		DBManager:     make(map[string]*Database),
+		Subscriptions: NewSubscriptions(),
+		Broker:        NewLocalBroker(),
+		node:          uuid.New(),
 	}
-	app.Parse("./config.json")
+	app.Hub = NewHub(app)
 	return app
 }
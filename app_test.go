@@ -0,0 +1,194 @@
+//    Title: app_test.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestApp creates and opens an app keeping its data in memory,
+// with the extra config.json fields in extra, and stops it when the test ends.
+func newTestApp(t *testing.T, extra string) *App {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "base.html"), []byte(`{{define "base"}}{{end}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := fmt.Sprintf(`{
+		"cookiename": "rtgo",
+		"views": %q,
+		"database": {"memory": {"tables": "test"}}%s
+	}`, filepath.Join(dir, "*"), extra)
+	app, err := NewAppWithConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(app.Stop)
+	return app
+}
+
+// dialTestApp opens a WebSocket connection to app served by a test server,
+// requesting subprotocols, if any.
+func dialTestApp(t *testing.T, app *App, subprotocols ...string) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(app.Handler())
+	t.Cleanup(srv.Close)
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// readUntil reads messages from ws until one has event, failing after a second.
+func readUntil(t *testing.T, ws *websocket.Conn, event string) *Message {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		msg := &Message{}
+		if err := ws.ReadJSON(msg); err != nil {
+			t.Fatalf("waiting for %s: %v", event, err)
+		}
+		if msg.Event == event {
+			return msg
+		}
+	}
+}
+
+func TestNewAppWithConfigInvalid(t *testing.T) {
+	configs := []string{
+		`{`,
+		`{"views": "/nonexistent/*"}`,
+		`{"limits": {"default": {"overflow": "sometimes"}}}`,
+		`{"resume": {"grace": "-1s"}}`,
+	}
+	for _, config := range configs {
+		if _, err := NewAppWithConfig([]byte(config)); err == nil {
+			t.Errorf("NewAppWithConfig(%s) succeeded", config)
+		}
+	}
+}
+
+func TestAppMemoryDatabase(t *testing.T) {
+	app := newTestApp(t, "")
+	db, ok := app.DBManager["memory"]
+	if !ok {
+		t.Fatal("memory database not opened")
+	}
+	if err := db.InsertObj("test", "a", map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertObj("test", "a", map[string]interface{}{"n": 2}); err == nil {
+		t.Error("inserting an existing key succeeded")
+	}
+	obj, err := db.GetObj("test", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := obj.(map[string]interface{})["n"]; n != float64(1) {
+		t.Errorf("got n = %v, want 1", n)
+	}
+	if app.SessionManager == nil {
+		t.Error("session manager not opened")
+	}
+}
+
+func TestAppSocketRPC(t *testing.T) {
+	app := newTestApp(t, "")
+	app.HandleRPC("echo", func(ctx context.Context, c *Conn, payload json.RawMessage) (interface{}, error) {
+		return payload, nil
+	})
+	ws := dialTestApp(t, app)
+	readUntil(t, ws, "join")
+	if err := ws.WriteJSON(&Message{Room: "root", Event: "echo", ID: "1", Payload: json.RawMessage(`{"hello":"world"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	reply := readUntil(t, ws, "result")
+	if reply.ID != "1" || string(reply.Payload) != `{"hello":"world"}` {
+		t.Errorf("got reply %s %s", reply.ID, reply.Payload)
+	}
+}
+
+func TestReadCeiling(t *testing.T) {
+	app := newTestApp(t, `, "limits": {"default": {"readlimit": "16"}}`)
+	ws := dialTestApp(t, app)
+	readUntil(t, ws, "join")
+	if err := ws.WriteMessage(websocket.TextMessage, make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	reply := readUntil(t, ws, "error")
+	var e Error
+	if err := json.Unmarshal(reply.Payload, &e); err != nil || e.Code != ErrMessageTooLarge.Code {
+		t.Fatalf("got %s", reply.Payload)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, make([]byte, 16*discardFactor+1)); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Errorf("got %v, want a message too big close", err)
+			}
+			return
+		}
+	}
+}
+
+func TestConnRoomsConcurrent(t *testing.T) {
+	app := newTestApp(t, `, "limits": {"default": {"sendbuffer": "4096"}}`)
+	app.HandleRPC("hop", func(ctx context.Context, c *Conn, payload json.RawMessage) (interface{}, error) {
+		for i := 0; i < 20; i++ {
+			name := fmt.Sprint("rpc", i)
+			c.Join(name)
+			c.Leave(name)
+		}
+		return nil, nil
+	})
+	ws := dialTestApp(t, app)
+	readUntil(t, ws, "join")
+	for i := 0; i < 20; i++ {
+		msgs := []*Message{
+			{Room: "root", Event: "hop", ID: fmt.Sprint(i)},
+			{Room: fmt.Sprint("client", i), Event: "join"},
+			{Room: fmt.Sprint("client", i), Event: "listMembers", ID: fmt.Sprint("m", i)},
+		}
+		for _, msg := range msgs {
+			if err := ws.WriteJSON(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 20; i++ {
+		readUntil(t, ws, "result")
+	}
+}
@@ -0,0 +1,254 @@
+//    Title: broker.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBroker("local", func(params map[string]string) (Broker, error) {
+		return NewLocalBroker(), nil
+	})
+}
+
+// Broker carries the messages of rooms between the instances of an app,
+// so that rooms span every instance sharing the broker.
+// Every room publishes what is emitted in it through the broker and receives
+// from it what every instance published, its own messages included.
+// The broker numbers the messages of each room; the sequence numbers it
+// delivers increase with every message published to the room, also across
+// restarts of the broker, see NextSeq.
+type Broker interface {
+	// Publish sends data to every subscriber of room.
+	Publish(room string, data []byte) error
+	// Subscribe calls fn with every message published to room until the
+	// subscription is cancelled. fn must not block.
+	Subscribe(room string, fn func(seq uint64, data []byte)) (Subscription, error)
+	// Close releases the broker's resources.
+	Close() error
+}
+
+// Subscription is a subscription made with Broker.Subscribe.
+type Subscription interface {
+	// Unsubscribe cancels the subscription.
+	Unsubscribe() error
+}
+
+// BrokerFactory creates a Broker from the cluster block of config.json.
+type BrokerFactory func(params map[string]string) (Broker, error)
+
+// ErrBrokerClosed is returned by brokers used after being closed.
+var ErrBrokerClosed = errors.New("rtgo: broker closed")
+
+var (
+	brokersMu sync.RWMutex
+	brokers   = make(map[string]BrokerFactory)
+)
+
+// RegisterBroker makes a broker available under name.
+// It panics if factory is nil or if RegisterBroker is called twice with the same name.
+func RegisterBroker(name string, factory BrokerFactory) {
+	brokersMu.Lock()
+	defer brokersMu.Unlock()
+	if factory == nil {
+		panic("rtgo: RegisterBroker factory is nil")
+	}
+	if _, dup := brokers[name]; dup {
+		panic("rtgo: RegisterBroker called twice for broker " + name)
+	}
+	brokers[name] = factory
+}
+
+// Brokers returns a sorted list of the names of the registered brokers.
+func Brokers() []string {
+	brokersMu.RLock()
+	defer brokersMu.RUnlock()
+	list := make([]string, 0, len(brokers))
+	for name := range brokers {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// OpenBroker creates a new Broker using the factory registered under name.
+// It returns the new broker or an error.
+func OpenBroker(name string, params map[string]string) (Broker, error) {
+	brokersMu.RLock()
+	factory, ok := brokers[name]
+	brokersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Broker %s is not registered.", name)
+	}
+	return factory(params)
+}
+
+// LocalBroker is a Broker for a single instance; it delivers messages to
+// the subscribers of the process that published them.
+type LocalBroker struct {
+	mu     sync.RWMutex
+	subs   map[string]map[*localSubscription]bool
+	seqs   map[string]uint64
+	closed bool
+}
+
+// localSubscription is a subscription to a LocalBroker.
+type localSubscription struct {
+	broker *LocalBroker
+	room   string
+	fn     func(seq uint64, data []byte)
+}
+
+// NewLocalBroker creates a broker for a single instance.
+// It returns the new broker.
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{
+		subs: make(map[string]map[*localSubscription]bool),
+		seqs: make(map[string]uint64),
+	}
+}
+
+// Publish numbers data and passes it to every subscriber of room.
+func (b *LocalBroker) Publish(room string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	b.seqs[room] = NextSeq(b.seqs[room])
+	for s := range b.subs[room] {
+		s.fn(b.seqs[room], data)
+	}
+	return nil
+}
+
+// Subscribe calls fn with every message published to room.
+func (b *LocalBroker) Subscribe(room string, fn func(seq uint64, data []byte)) (Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+	s := &localSubscription{broker: b, room: room, fn: fn}
+	if _, ok := b.subs[room]; !ok {
+		b.subs[room] = make(map[*localSubscription]bool)
+	}
+	b.subs[room][s] = true
+	return s, nil
+}
+
+// Close drops every subscription.
+func (b *LocalBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.subs = make(map[string]map[*localSubscription]bool)
+	return nil
+}
+
+// Unsubscribe cancels the subscription.
+// The sequence numbers of a room are kept once it has no subscribers left.
+func (s *localSubscription) Unsubscribe() error {
+	b := s.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs[s.room], s)
+	if len(b.subs[s.room]) == 0 {
+		delete(b.subs, s.room)
+	}
+	return nil
+}
+
+// NextSeq returns the sequence number following last: the current time in
+// microseconds, or last + 1 if that is not above last. Numbers thus keep
+// increasing when a broker restarts, and stay exact in JavaScript.
+func NextSeq(last uint64) uint64 {
+	seq := uint64(time.Now().UnixNano() / 1000)
+	if seq <= last {
+		seq = last + 1
+	}
+	return seq
+}
+
+// DefaultHeartbeat is the interval at which instances announce the members
+// of their rooms when the cluster block of config.json sets none.
+var DefaultHeartbeat = 10 * time.Second
+
+// envelope is what rooms publish through the broker.
+// Kind is "emit" for a message emitted in the room, "presence" for a member
+// joining, leaving or changing its state, "sync" for an instance asking the
+// others for their members, and "members" for an instance's members.
+type envelope struct {
+	Node    string   `json:"node"`
+	Kind    string   `json:"kind"`
+	Message *Message `json:"message,omitempty"`
+	Action  string   `json:"action,omitempty"`
+	Members []Member `json:"members,omitempty"`
+}
+
+// remoteNode holds the members of a room on another instance.
+type remoteNode struct {
+	members map[string]Member
+	seen    time.Time
+}
+
+// Heartbeat returns the interval at which the instance announces the
+// members of its rooms to the other instances; those of an instance not
+// heard of for three intervals are dropped.
+func (a *App) Heartbeat() time.Duration {
+	if val, ok := a.Cluster["heartbeat"]; ok {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			return d
+		}
+	}
+	return DefaultHeartbeat
+}
+
+// checkCluster validates the cluster block of config.json.
+// It returns an error if it is invalid.
+func (a *App) checkCluster() error {
+	if val, ok := a.Cluster["heartbeat"]; ok {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("cluster: %v", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("cluster: heartbeat must be positive, got %s", d)
+		}
+	}
+	return nil
+}
+
+// openBroker opens the broker named in the broker field of the cluster
+// block of config.json. Without one, the app keeps its local broker.
+func (a *App) openBroker() error {
+	name := a.Cluster["broker"]
+	if name == "" {
+		return nil
+	}
+	broker, err := OpenBroker(name, a.Cluster)
+	if err != nil {
+		return err
+	}
+	a.Broker = broker
+	return nil
+}
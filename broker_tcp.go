@@ -0,0 +1,450 @@
+//    Title: broker_tcp.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBroker("tcp", newTCPBroker)
+}
+
+// ErrBrokerUnavailable is returned by TCPBroker.Publish while it is
+// disconnected from its broker server.
+var ErrBrokerUnavailable = errors.New("rtgo: broker unavailable")
+
+// brokerFrame is what TCP brokers and broker servers exchange, one JSON
+// object per line. Clients send an "auth" frame with the shared secret
+// first, if the server has one, then "sub", "unsub" and "pub" frames;
+// servers send "msg" frames numbered by room.
+type brokerFrame struct {
+	Op     string `json:"op"`
+	Room   string `json:"room"`
+	Seq    uint64 `json:"seq,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// brokerWriteWait is the time allowed to write a frame.
+const brokerWriteWait = 10 * time.Second
+
+// BrokerServer relays the messages of TCPBroker clients, numbering them by
+// room. It is the reference broker shipped with rtgo, run by `rtgo broker`.
+// Clients can publish to any room, so a server without a Secret must only
+// be reachable by the instances of the app. If Secret is set before serving,
+// clients not sending it within brokerWriteWait of connecting are dropped.
+type BrokerServer struct {
+	Secret    string
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	peers     map[*brokerPeer]bool
+	rooms     map[string]map[*brokerPeer]bool
+	seqs      map[string]uint64
+	closed    bool
+}
+
+// brokerPeer is a client connected to a BrokerServer.
+type brokerPeer struct {
+	conn  net.Conn
+	send  chan *brokerFrame
+	rooms map[string]bool
+}
+
+// NewBrokerServer creates a broker server.
+// It returns the new server.
+func NewBrokerServer() *BrokerServer {
+	return &BrokerServer{
+		listeners: make(map[net.Listener]bool),
+		peers:     make(map[*brokerPeer]bool),
+		rooms:     make(map[string]map[*brokerPeer]bool),
+		seqs:      make(map[string]uint64),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients.
+// It returns an error if any occur.
+func (s *BrokerServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the clients connecting to l until the server is closed.
+// It returns an error if any occur.
+func (s *BrokerServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrBrokerClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrBrokerClosed
+			}
+			return err
+		}
+		p := &brokerPeer{
+			conn:  conn,
+			send:  make(chan *brokerFrame, 1024),
+			rooms: make(map[string]bool),
+		}
+		s.mu.Lock()
+		s.peers[p] = true
+		s.mu.Unlock()
+		go s.writePeer(p)
+		go s.readPeer(p)
+	}
+}
+
+// Close stops listening and disconnects every client.
+func (s *BrokerServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for p := range s.peers {
+		p.conn.Close()
+	}
+	return nil
+}
+
+// readPeer handles the frames sent by a client until it disconnects.
+func (s *BrokerServer) readPeer(p *brokerPeer) {
+	defer s.dropPeer(p)
+	dec := json.NewDecoder(bufio.NewReader(p.conn))
+	if !s.authenticate(p, dec) {
+		log.Println("broker: refusing unauthenticated client", p.conn.RemoteAddr())
+		return
+	}
+	for {
+		frame := &brokerFrame{}
+		if err := dec.Decode(frame); err != nil {
+			return
+		}
+		s.mu.Lock()
+		switch frame.Op {
+		case "sub":
+			if _, ok := s.rooms[frame.Room]; !ok {
+				s.rooms[frame.Room] = make(map[*brokerPeer]bool)
+			}
+			s.rooms[frame.Room][p] = true
+			p.rooms[frame.Room] = true
+		case "unsub":
+			s.unsubscribe(p, frame.Room)
+		case "pub":
+			s.seqs[frame.Room] = NextSeq(s.seqs[frame.Room])
+			msg := &brokerFrame{
+				Op:   "msg",
+				Room: frame.Room,
+				Seq:  s.seqs[frame.Room],
+				Data: frame.Data,
+			}
+			for peer := range s.rooms[frame.Room] {
+				select {
+				case peer.send <- msg:
+				default:
+					log.Println("broker: disconnecting slow client", peer.conn.RemoteAddr())
+					peer.conn.Close()
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// authenticate reads the auth frame of a client, if the server has a secret.
+// It returns false if the client did not send the secret in time.
+func (s *BrokerServer) authenticate(p *brokerPeer, dec *json.Decoder) bool {
+	if s.Secret == "" {
+		return true
+	}
+	p.conn.SetReadDeadline(time.Now().Add(brokerWriteWait))
+	frame := &brokerFrame{}
+	if err := dec.Decode(frame); err != nil || frame.Op != "auth" {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(frame.Secret), []byte(s.Secret)) != 1 {
+		return false
+	}
+	p.conn.SetReadDeadline(time.Time{})
+	return true
+}
+
+// writePeer sends the frames queued for a client.
+func (s *BrokerServer) writePeer(p *brokerPeer) {
+	w := bufio.NewWriter(p.conn)
+	enc := json.NewEncoder(w)
+	for frame := range p.send {
+		p.conn.SetWriteDeadline(time.Now().Add(brokerWriteWait))
+		if err := enc.Encode(frame); err != nil {
+			p.conn.Close()
+			return
+		}
+		if len(p.send) == 0 {
+			if err := w.Flush(); err != nil {
+				p.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// dropPeer removes a disconnected client.
+func (s *BrokerServer) dropPeer(p *brokerPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for room := range p.rooms {
+		s.unsubscribe(p, room)
+	}
+	delete(s.peers, p)
+	close(p.send)
+	p.conn.Close()
+}
+
+// unsubscribe removes a client from a room. It must be called with s.mu held.
+func (s *BrokerServer) unsubscribe(p *brokerPeer, room string) {
+	delete(s.rooms[room], p)
+	if len(s.rooms[room]) == 0 {
+		delete(s.rooms, room)
+	}
+	delete(p.rooms, room)
+}
+
+// TCPBroker is a Broker connected to a BrokerServer. If the connection
+// drops, it reconnects and subscribes again, backing off up to five seconds
+// between attempts; messages published in the meantime are refused.
+type TCPBroker struct {
+	addr   string
+	secret string
+	mu     sync.Mutex
+	conn   net.Conn
+	enc    *json.Encoder
+	subs   map[string]map[*tcpSubscription]bool
+	closed bool
+}
+
+// tcpSubscription is a subscription to a TCPBroker.
+type tcpSubscription struct {
+	broker *TCPBroker
+	room   string
+	fn     func(seq uint64, data []byte)
+}
+
+// newTCPBroker creates a TCPBroker from the cluster block of config.json,
+// whose addr field is the address of the broker server and secret field
+// the secret it shares with its clients, if any.
+func newTCPBroker(params map[string]string) (Broker, error) {
+	if params["addr"] == "" {
+		return nil, fmt.Errorf("The tcp broker needs an addr.")
+	}
+	return DialBrokerWithSecret(params["addr"], params["secret"])
+}
+
+// DialBroker connects to the broker server at the TCP address addr,
+// which has no secret.
+// It returns the new broker or an error.
+func DialBroker(addr string) (*TCPBroker, error) {
+	return DialBrokerWithSecret(addr, "")
+}
+
+// DialBrokerWithSecret connects to the broker server at the TCP address
+// addr, authenticating with secret whenever it connects.
+// It returns the new broker or an error.
+func DialBrokerWithSecret(addr string, secret string) (*TCPBroker, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	b := &TCPBroker{
+		addr:   addr,
+		secret: secret,
+		subs:   make(map[string]map[*tcpSubscription]bool),
+	}
+	b.setConn(conn)
+	go b.readLoop(conn)
+	return b, nil
+}
+
+// setConn starts using conn, authenticating and subscribing again
+// to every room.
+func (b *TCPBroker) setConn(conn net.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn = conn
+	b.enc = json.NewEncoder(conn)
+	if b.secret != "" {
+		b.write(&brokerFrame{Op: "auth", Secret: b.secret})
+	}
+	for room := range b.subs {
+		b.write(&brokerFrame{Op: "sub", Room: room})
+	}
+}
+
+// write sends a frame to the server. It must be called with b.mu held.
+func (b *TCPBroker) write(frame *brokerFrame) error {
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	if b.conn == nil {
+		return ErrBrokerUnavailable
+	}
+	b.conn.SetWriteDeadline(time.Now().Add(brokerWriteWait))
+	if err := b.enc.Encode(frame); err != nil {
+		b.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// readLoop passes the messages received on conn to the subscribers of their
+// room, and reconnects once conn drops.
+func (b *TCPBroker) readLoop(conn net.Conn) {
+	for {
+		dec := json.NewDecoder(bufio.NewReader(conn))
+		for {
+			frame := &brokerFrame{}
+			if err := dec.Decode(frame); err != nil {
+				break
+			}
+			b.mu.Lock()
+			subs := make([]*tcpSubscription, 0, len(b.subs[frame.Room]))
+			for s := range b.subs[frame.Room] {
+				subs = append(subs, s)
+			}
+			b.mu.Unlock()
+			for _, s := range subs {
+				s.fn(frame.Seq, frame.Data)
+			}
+		}
+		conn.Close()
+		b.mu.Lock()
+		b.conn = nil
+		closed := b.closed
+		b.mu.Unlock()
+		if closed {
+			return
+		}
+		conn = b.redial()
+		if conn == nil {
+			return
+		}
+		b.setConn(conn)
+	}
+}
+
+// redial connects to the server again, doubling the delay between attempts.
+// It returns the new connection, or nil once the broker is closed.
+func (b *TCPBroker) redial() net.Conn {
+	delay := 100 * time.Millisecond
+	for {
+		time.Sleep(delay)
+		b.mu.Lock()
+		closed := b.closed
+		b.mu.Unlock()
+		if closed {
+			return nil
+		}
+		conn, err := net.Dial("tcp", b.addr)
+		if err == nil {
+			return conn
+		}
+		log.Println("broker: reconnecting to", b.addr+":", err)
+		if delay *= 2; delay > 5*time.Second {
+			delay = 5 * time.Second
+		}
+	}
+}
+
+// Publish sends data to every subscriber of room.
+func (b *TCPBroker) Publish(room string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.write(&brokerFrame{Op: "pub", Room: room, Data: data})
+}
+
+// Subscribe calls fn with every message published to room.
+// Subscribing while disconnected succeeds; the subscription is made
+// once the broker reconnects.
+func (b *TCPBroker) Subscribe(room string, fn func(seq uint64, data []byte)) (Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+	s := &tcpSubscription{broker: b, room: room, fn: fn}
+	if _, ok := b.subs[room]; !ok {
+		b.subs[room] = make(map[*tcpSubscription]bool)
+		if err := b.write(&brokerFrame{Op: "sub", Room: room}); err != nil && err != ErrBrokerUnavailable {
+			log.Println("broker: subscribing to", room+":", err)
+		}
+	}
+	b.subs[room][s] = true
+	return s, nil
+}
+
+// Close disconnects from the server.
+func (b *TCPBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	if b.conn != nil {
+		return b.conn.Close()
+	}
+	return nil
+}
+
+// Unsubscribe cancels the subscription.
+func (s *tcpSubscription) Unsubscribe() error {
+	b := s.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs[s.room], s)
+	if len(b.subs[s.room]) > 0 {
+		return nil
+	}
+	delete(b.subs, s.room)
+	if err := b.write(&brokerFrame{Op: "unsub", Room: s.room}); err != nil && err != ErrBrokerUnavailable && err != ErrBrokerClosed {
+		return err
+	}
+	return nil
+}
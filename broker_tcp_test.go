@@ -0,0 +1,83 @@
+//    Title: broker_tcp_test.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// serveBroker serves a broker server with secret on a local port
+// until the test ends.
+// It returns the server's address.
+func serveBroker(t *testing.T, secret string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewBrokerServer()
+	server.Secret = secret
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return l.Addr().String()
+}
+
+// receives reports whether a message published by pub reaches sub.
+func receives(t *testing.T, pub *TCPBroker, sub *TCPBroker) bool {
+	t.Helper()
+	got := make(chan []byte, 1)
+	if _, err := sub.Subscribe("room", func(seq uint64, data []byte) {
+		got <- data
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	pub.Publish("room", []byte("hello"))
+	select {
+	case <-got:
+		return true
+	case <-time.After(200 * time.Millisecond):
+		return false
+	}
+}
+
+func TestBrokerSecret(t *testing.T) {
+	addr := serveBroker(t, "s3cret")
+	sub, err := DialBrokerWithSecret(addr, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	intruder, err := DialBrokerWithSecret(addr, "guess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer intruder.Close()
+	if receives(t, intruder, sub) {
+		t.Error("message published without the secret was relayed")
+	}
+	pub, err := DialBrokerWithSecret(addr, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if !receives(t, pub, sub) {
+		t.Error("message published with the secret was not relayed")
+	}
+}
@@ -17,12 +17,15 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/jdeezy/rtgo"
 	"io/ioutil"
 	"log"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -42,6 +45,10 @@ var (
 	del        = flag.Bool("del", false, "Delete either a view or controller.")
 	view       = flag.String("view", "", "The name of the view to add or delete.")
 	controller = flag.String("controller", "", "The name of the controller to add or delete.")
+	steps      = flag.Int("steps", 1, "The number of migrations to revert with migrate down.")
+	keep       = flag.Int("keep", 2, "The number of cookie keys to keep with keys rotate.")
+	addr       = flag.String("addr", "127.0.0.1:7070", "The address the broker listens on.")
+	secret     = flag.String("secret", "", "The secret broker clients must send; defaults to $RTGO_BROKER_SECRET.")
 )
 
 // initDirectory initializes a directory.
@@ -129,8 +136,148 @@ func AddView(name string) error {
 	return nil
 }
 
+// openDatabases starts every database in config.json without applying migrations.
+// It returns the databases ordered by name.
+func openDatabases() (*rtgo.App, []string) {
+	app := rtgo.NewApp()
+	names := make([]string, 0, len(app.Database))
+	for name, params := range app.Database {
+		app.NewDatabase(name, params)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return app, names
+}
+
+// Migrate runs a migrate command (up, down or status) against every SQL database in config.json,
+// with the migrations in its migrations directory, which app start applies as well.
+func Migrate(command string) error {
+	app, names := openDatabases()
+	defer app.Stop()
+	dir := app.Migrations
+	if dir == "" {
+		return fmt.Errorf("No migrations directory set in config.json.")
+	}
+	for _, name := range names {
+		db := app.DBManager[name]
+		if _, ok := db.Store().(rtgo.SQLBackend); !ok {
+			continue
+		}
+		switch command {
+		case "up":
+			done, err := db.MigrateUp(dir)
+			for _, m := range done {
+				fmt.Printf("%s: applied %d_%s\n", name, m.Version, m.Name)
+			}
+			if err != nil {
+				return err
+			}
+		case "down":
+			done, err := db.MigrateDown(dir, *steps)
+			for _, m := range done {
+				fmt.Printf("%s: reverted %d_%s\n", name, m.Version, m.Name)
+			}
+			if err != nil {
+				return err
+			}
+		case "status":
+			status, err := db.MigrationStatus(dir)
+			if err != nil {
+				return err
+			}
+			for _, s := range status {
+				state := "pending"
+				if s.Applied {
+					state = "applied"
+				}
+				fmt.Printf("%s: %d_%s %s\n", name, s.Version, s.Name, state)
+			}
+		default:
+			return fmt.Errorf("Unknown migrate command: %s", command)
+		}
+	}
+	return nil
+}
+
+// RotateKeys adds a new cookie key to the key file named in config.json,
+// which the app reads its keys from, keeping the newest keys.
+func RotateKeys() error {
+	config := struct{ Keyfile string }{}
+	if file, err := ioutil.ReadFile("./config.json"); err == nil {
+		if err := json.Unmarshal(file, &config); err != nil {
+			return err
+		}
+	}
+	if config.Keyfile == "" {
+		return fmt.Errorf("No keyfile set in config.json.")
+	}
+	keys, err := rtgo.RotateKeyFile(config.Keyfile, *keep)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s now holds %d keys; restart the app to sign cookies with the new key\n", config.Keyfile, len(keys))
+	return nil
+}
+
+// HashPassword prints the hash of password made with the hasher configured
+// in the passwords block of config.json, e.g. for the password of a room.
+func HashPassword(password string) error {
+	config := struct{ Passwords map[string]string }{}
+	if file, err := ioutil.ReadFile("./config.json"); err == nil {
+		if err := json.Unmarshal(file, &config); err != nil {
+			return err
+		}
+	}
+	hasher, err := rtgo.NewPasswordHasher(config.Passwords)
+	if err != nil {
+		return err
+	}
+	encoded, err := hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	fmt.Println(encoded)
+	return nil
+}
+
 func main() {
 	flag.Parse()
+	if flag.Arg(0) == "keys" {
+		if flag.Arg(1) != "rotate" {
+			log.Fatal("Unknown keys command: ", flag.Arg(1))
+		}
+		if err := RotateKeys(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "hash" {
+		if flag.Arg(1) == "" {
+			log.Fatal("No password to hash")
+		}
+		if err := HashPassword(flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "broker" {
+		server := rtgo.NewBrokerServer()
+		if *secret == "" {
+			*secret = os.Getenv("RTGO_BROKER_SECRET")
+		}
+		server.Secret = *secret
+		if *secret == "" {
+			log.Println("broker has no secret; anyone reaching", *addr, "can publish to every room")
+		}
+		log.Println("broker listening on", *addr)
+		log.Fatal(server.ListenAndServe(*addr))
+	}
+	if flag.Arg(0) == "migrate" {
+		if err := Migrate(flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if *add {
 		if *controller != "" {
 			if err := AddController(*controller); err != nil {
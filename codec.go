@@ -0,0 +1,257 @@
+//    Title: codec.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/fxamacker/cbor"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Codec encodes and decodes the messages exchanged over a WebSocket connection.
+// The codec of a connection is negotiated through the WebSocket subprotocol
+// returned by Name; connections that request none of the registered
+// subprotocols use the JSON codec.
+// Messages encoded by a binary codec are written in binary frames.
+type Codec interface {
+	Name() string
+	Binary() bool
+	Encode(m *Message) ([]byte, error)
+	Decode(data []byte, m *Message) error
+}
+
+var (
+	codecsMu   sync.RWMutex
+	codecs     = make(map[string]Codec)
+	codecNames []string
+)
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(MsgpackCodec{})
+	RegisterCodec(CBORCodec{})
+}
+
+// RegisterCodec makes a codec available to connections requesting
+// the subprotocol named by its Name.
+// Subprotocols are preferred in the order their codecs were registered.
+// It panics if codec is nil or if a codec with the same name is already registered.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if codec == nil {
+		panic("rtgo: RegisterCodec codec is nil")
+	}
+	if _, dup := codecs[codec.Name()]; dup {
+		panic("rtgo: RegisterCodec called twice for codec " + codec.Name())
+	}
+	codecs[codec.Name()] = codec
+	codecNames = append(codecNames, codec.Name())
+}
+
+// Subprotocols returns the names of the registered codecs in order of preference.
+func Subprotocols() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	names := make([]string, len(codecNames))
+	copy(names, codecNames)
+	return names
+}
+
+// codecFor returns the codec registered under the negotiated subprotocol,
+// or the JSON codec if there is none.
+func codecFor(subprotocol string) Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if codec, ok := codecs[subprotocol]; ok {
+		return codec
+	}
+	return JSONCodec{}
+}
+
+// JSONCodec encodes messages as JSON text frames.
+// Message.Data is base64 encoded.
+type JSONCodec struct{}
+
+// Name returns the subprotocol of the codec.
+func (JSONCodec) Name() string { return "rtgo.json" }
+
+// Binary reports whether the codec writes binary frames.
+func (JSONCodec) Binary() bool { return false }
+
+// Encode encodes a message.
+// It returns the encoded message or an error.
+func (JSONCodec) Encode(m *Message) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Decode decodes data into m.
+// It may return an error.
+func (JSONCodec) Decode(data []byte, m *Message) error {
+	return json.Unmarshal(data, m)
+}
+
+// MsgpackCodec encodes messages as MessagePack maps in binary frames.
+// Message.Data is encoded as a bin value.
+type MsgpackCodec struct{}
+
+// Name returns the subprotocol of the codec.
+func (MsgpackCodec) Name() string { return "rtgo.msgpack" }
+
+// Binary reports whether the codec writes binary frames.
+func (MsgpackCodec) Binary() bool { return true }
+
+// Encode encodes a message.
+// It returns the encoded message or an error.
+func (MsgpackCodec) Encode(m *Message) ([]byte, error) {
+	w, err := toWire(m)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := msgpack.NewEncoder(&buf).UseCompactEncoding(true).Encode(w); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes data into m.
+// It may return an error.
+func (MsgpackCodec) Decode(data []byte, m *Message) error {
+	w := &wireMessage{}
+	if err := msgpack.Unmarshal(data, w); err != nil {
+		return err
+	}
+	return fromWire(w, m)
+}
+
+// CBORCodec encodes messages as CBOR maps in binary frames.
+// Message.Data is encoded as a byte string.
+type CBORCodec struct{}
+
+// Name returns the subprotocol of the codec.
+func (CBORCodec) Name() string { return "rtgo.cbor" }
+
+// Binary reports whether the codec writes binary frames.
+func (CBORCodec) Binary() bool { return true }
+
+// Encode encodes a message.
+// It returns the encoded message or an error.
+func (CBORCodec) Encode(m *Message) ([]byte, error) {
+	w, err := toWire(m)
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(w, cbor.EncOptions{ShortestFloat: cbor.ShortestFloat16})
+}
+
+// Decode decodes data into m.
+// It may return an error.
+func (CBORCodec) Decode(data []byte, m *Message) error {
+	w := &wireMessage{}
+	if err := cbor.Unmarshal(data, w); err != nil {
+		return err
+	}
+	return fromWire(w, m)
+}
+
+// wireMessage is the form of a Message encoded by the binary codecs,
+// with the JSON payload decoded into plain values.
+type wireMessage struct {
+	Room    string      `msgpack:"room" cbor:"room"`
+	Event   string      `msgpack:"event" cbor:"event"`
+	ID      string      `msgpack:"id,omitempty" cbor:"id,omitempty"`
+	Seq     uint64      `msgpack:"seq,omitempty" cbor:"seq,omitempty"`
+	Payload interface{} `msgpack:"payload" cbor:"payload"`
+	Data    []byte      `msgpack:"data,omitempty" cbor:"data,omitempty"`
+}
+
+// toWire converts a message for the binary codecs.
+// Integral JSON numbers are kept as integers.
+// It returns the converted message or an error.
+func toWire(m *Message) (*wireMessage, error) {
+	w := &wireMessage{
+		Room:  m.Room,
+		Event: m.Event,
+		ID:    m.ID,
+		Seq:   m.Seq,
+		Data:  m.Data,
+	}
+	if len(m.Payload) == 0 {
+		return w, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(m.Payload))
+	dec.UseNumber()
+	if err := dec.Decode(&w.Payload); err != nil {
+		return nil, err
+	}
+	w.Payload = plainValue(w.Payload)
+	return w, nil
+}
+
+// fromWire converts a message decoded by a binary codec into m,
+// JSON encoding its payload.
+// It may return an error.
+func fromWire(w *wireMessage, m *Message) error {
+	payload, err := json.Marshal(plainValue(w.Payload))
+	if err != nil {
+		return err
+	}
+	m.Room = w.Room
+	m.Event = w.Event
+	m.ID = w.ID
+	m.Seq = w.Seq
+	m.Payload = payload
+	m.Data = w.Data
+	return nil
+}
+
+// plainValue converts json.Number values into integers or floats and maps
+// with non-string keys, as decoded by the binary codecs, into maps with
+// string keys, so that the value can be encoded by any codec.
+// It returns the converted value.
+func plainValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, val := range t {
+			t[k] = plainValue(val)
+		}
+		return t
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[fmt.Sprint(k)] = plainValue(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range t {
+			t[i] = plainValue(val)
+		}
+		return t
+	}
+	return v
+}
@@ -0,0 +1,119 @@
+//    Title: codec_test.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var testCodecs = []Codec{JSONCodec{}, MsgpackCodec{}, CBORCodec{}}
+
+func TestCodecRoundTrip(t *testing.T) {
+	messages := []*Message{
+		{Room: "root", Event: "join", Payload: json.RawMessage(`"c1"`)},
+		{Room: "chat", Event: "say", ID: "7", Seq: 42, Payload: json.RawMessage(`{"a":1,"b":[true,null,"x",2.5],"c":{"d":9007199254740993}}`)},
+		{Room: "files", Event: "streamChunk", Payload: json.RawMessage(`{"offset":0,"stream":"s1"}`), Data: []byte{0, 1, 2, 0xfe, 0xff}},
+	}
+	for _, codec := range testCodecs {
+		for _, m := range messages {
+			data, err := codec.Encode(m)
+			if err != nil {
+				t.Fatalf("%s: %v", codec.Name(), err)
+			}
+			got := &Message{}
+			if err := codec.Decode(data, got); err != nil {
+				t.Fatalf("%s: %v", codec.Name(), err)
+			}
+			if got.Room != m.Room || got.Event != m.Event || got.ID != m.ID || got.Seq != m.Seq {
+				t.Errorf("%s: got %+v, want %+v", codec.Name(), got, m)
+			}
+			if string(got.Payload) != string(m.Payload) {
+				t.Errorf("%s: got payload %s, want %s", codec.Name(), got.Payload, m.Payload)
+			}
+			if !bytes.Equal(got.Data, m.Data) {
+				t.Errorf("%s: got data %v, want %v", codec.Name(), got.Data, m.Data)
+			}
+		}
+	}
+}
+
+func TestCodecInvalid(t *testing.T) {
+	for _, codec := range testCodecs {
+		if err := codec.Decode([]byte{0xc1, 0xff, 0x00}, &Message{}); err == nil {
+			t.Errorf("%s decoded garbage", codec.Name())
+		}
+	}
+	if codecFor("rtgo.unknown").Name() != "rtgo.json" || codecFor("").Name() != "rtgo.json" {
+		t.Error("unknown subprotocols do not fall back to JSON")
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	app := newTestApp(t, "")
+	app.HandleRPC("echo", func(ctx context.Context, c *Conn, payload json.RawMessage) (interface{}, error) {
+		return payload, nil
+	})
+	for _, codec := range testCodecs {
+		ws := dialTestApp(t, app, "rtgo.unknown", codec.Name())
+		if ws.Subprotocol() != codec.Name() {
+			t.Fatalf("requested %s, got subprotocol %q", codec.Name(), ws.Subprotocol())
+		}
+		frameType := websocket.TextMessage
+		if codec.Binary() {
+			frameType = websocket.BinaryMessage
+		}
+		data, err := codec.Encode(&Message{Room: "root", Event: "echo", ID: "1", Payload: json.RawMessage(`{"n":3}`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ws.WriteMessage(frameType, data); err != nil {
+			t.Fatal(err)
+		}
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			mt, frame, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatalf("%s: %v", codec.Name(), err)
+			}
+			if mt != frameType {
+				t.Fatalf("%s: got frame type %d, want %d", codec.Name(), mt, frameType)
+			}
+			msg := &Message{}
+			if err := codec.Decode(frame, msg); err != nil {
+				t.Fatalf("%s: %v", codec.Name(), err)
+			}
+			if msg.Event != "result" {
+				continue
+			}
+			if msg.ID != "1" || string(msg.Payload) != `{"n":3}` {
+				t.Errorf("%s: got result %s %s", codec.Name(), msg.ID, msg.Payload)
+			}
+			break
+		}
+	}
+	ws := dialTestApp(t, app)
+	if ws.Subprotocol() != "" {
+		t.Errorf("got subprotocol %q without requesting one", ws.Subprotocol())
+	}
+	readUntil(t, ws, "join")
+}
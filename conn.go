@@ -18,37 +18,73 @@ package rtgo
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"github.com/gorilla/websocket"
 	"io"
+	"io/ioutil"
 	"log"
-	"net/http"
+	"net"
+	"sync"
 	"time"
 )
 
-const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
-)
-
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  4096,
 	WriteBufferSize: 4096,
-	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
 type Conn struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
 	app       *App
+	mu        sync.Mutex
 	socket    *websocket.Conn
+	quit      chan struct{}
+	written   chan struct{}
+	token     string
+	parked    *time.Timer
+	live      bool
+	closing   bool
+	closeOnce sync.Once
 	id        string
-	send      chan []byte
+	addr      string
+	codec     Codec
+	limits    Limits
+	streams   *streams
+	out       *outbox
+	roomsMu   sync.RWMutex
 	rooms     map[string]*Room
+	session   string
+	touched   time.Time
+	username  string
 	privilege string
 }
 
+// ID returns the id of the connection.
+func (c *Conn) ID() string {
+	return c.id
+}
+
+// Username returns the name of the user the connection was opened for,
+// or an empty string for guests.
+func (c *Conn) Username() string {
+	return c.username
+}
+
+// remoteHost returns the host of a connection's remote address,
+// or an empty string if it is unknown.
+func remoteHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
 // SendView sends the view matching requested path.
 func (c *Conn) SendView(path string) {
 	var doc bytes.Buffer
@@ -58,6 +94,11 @@ func (c *Conn) SendView(path string) {
 		log.Println("No template for the specified path: ", path)
 		return
 	}
+	query, err := ParseQuery(route)
+	if err != nil {
+		log.Println("Invalid query for the specified path: ", path, err)
+		return
+	}
 	collection := make([]interface{}, 0)
 	if _, ok := route["table"]; ok {
 		for _, db := range c.app.DBManager {
@@ -68,176 +109,409 @@ func (c *Conn) SendView(path string) {
 				}
 				collection = append(collection, obj)
 				break
+			} else if query != nil {
+				if collection, err = db.QueryObjs(route["table"], query); err == nil {
+					break
+				}
 			} else if collection, err = db.GetAllObjs(route["table"]); err == nil {
 				break
 			}
 		}
 	}
 	c.app.Templates.ExecuteTemplate(&doc, route["template"], collection)
-	response := map[string]interface{}{
-		"room":  "root",
-		"event": "response",
-		"payload": map[string]string{
-			"template":   doc.String(),
-			"controller": route["controller"],
-		},
-	}
-	data, err := json.Marshal(&response)
+	response, err := NewMessage("root", "response", map[string]string{
+		"template":   doc.String(),
+		"controller": route["controller"],
+	})
 	if err != nil {
 		log.Println("error encoding json: ", err)
 		return
 	}
-	c.send <- data
+	c.Send(response)
 }
 
 // HandleData routes a received message.
+// A returned error is sent back to the connection by ReadPump as an error event.
+// Messages for a handler registered with App.HandleRPC are answered with its result.
 // By default, the message is emitted on the WSEmitter.
+// Messages the connection's role has no permission for are answered with an error event.
 // It returns an error if any occur.
 func (c *Conn) HandleData(data *Message) error {
 	switch data.Event {
 	default:
+		if handler, ok := c.app.rpcHandler(data.Event); ok {
+			if !c.Can("rpc:" + data.Event) {
+				c.Deny(data)
+				return nil
+			}
+			c.Call(handler, data)
+			return nil
+		}
+		if !c.Can("event:" + data.Event) {
+			c.Deny(data)
+			return nil
+		}
 		c.app.Emitter.Emit(data.Event, c, data)
 	case "join":
-		c.Join(data.Room)
+		return c.HandleJoin(data)
 	case "leave":
 		c.Leave(data.Room)
 	case "request":
-		c.SendView(data.Payload)
-	case "getObj":
-		if c.privilege != "admin" {
-			return nil
-		}
-		payload := &DBMessage{}
-		if err := json.Unmarshal([]byte(data.Payload), payload); err != nil {
+		var path string
+		if err := data.Decode(&path); err != nil {
 			return err
 		}
-		if _, exists := c.app.DBManager[payload.DB]; !exists {
-			return errors.New("Database does not exist.")
+		c.SendView(path)
+	case "getObj", "insertObj", "updateObj", "upsertObj", "deleteObj", "subscribe", "unsubscribe":
+		return c.HandleDBData(data)
+	case "streamOpen", "streamChunk", "streamAck", "streamClose", "streamResume":
+		return c.HandleStreamData(data)
+	case "setState", "listMembers":
+		return c.HandlePresenceData(data)
+	case "listSessions":
+		if !c.Can(data.Event) {
+			c.Deny(data)
+			return nil
 		}
-		obj, err := c.app.DBManager[payload.DB].GetObj(payload.Table, payload.Key)
+		sessions, err := c.app.SessionManager.Infos()
 		if err != nil {
 			return err
 		}
-		newdata := &Message{
-			Room:    "root",
-			Event:   "gotObj",
-			Payload: obj.(string),
+		msg, err := NewMessage("root", "sessions", sessions)
+		if err != nil {
+			return err
 		}
-		c.Emit(newdata)
-	case "insertObj":
-		if c.privilege != "admin" {
+		c.Send(msg)
+	case "killSession":
+		if !c.Can(data.Event) {
+			c.Deny(data)
 			return nil
 		}
-		payload := &DBMessage{}
-		if err := json.Unmarshal([]byte(data.Payload), payload); err != nil {
+		var id string
+		if err := data.Decode(&id); err != nil {
 			return err
 		}
-		if _, exists := c.app.DBManager[payload.DB]; !exists {
-			return errors.New("Database does not exist.")
+		if err := c.app.SessionManager.RevokePublic(id); err != nil {
+			return err
 		}
-		if err := c.app.DBManager[payload.DB].InsertObj(payload.Table, payload.Key, payload.Data); err != nil {
+	}
+	return nil
+}
+
+// HandleDBData handles a message operating on a database table.
+// The connection's role needs the <event>:<db>:<table> permission,
+// and getObj:<db>:<table> as well to subscribe.
+// It returns an error if any occur.
+func (c *Conn) HandleDBData(data *Message) error {
+	payload := &DBMessage{}
+	if err := data.Decode(payload); err != nil {
+		return err
+	}
+	var obj interface{}
+	if len(payload.Data) > 0 {
+		if err := DecodePayload(payload.Data, &obj); err != nil {
 			return err
 		}
-	case "deleteObj":
-		if c.privilege != "admin" {
-			return nil
+	}
+	if !c.Can(data.Event + ":" + payload.DB + ":" + payload.Table) {
+		c.Deny(data)
+		return nil
+	}
+	if data.Event == "subscribe" && !c.Can("getObj:"+payload.DB+":"+payload.Table) {
+		c.Deny(data)
+		return nil
+	}
+	db, exists := c.app.DBManager[payload.DB]
+	if !exists {
+		return ErrDatabaseNotFound
+	}
+	if !db.HasTable(payload.Table) {
+		return ErrTableNotFound
+	}
+	switch data.Event {
+	case "getObj":
+		obj, err := db.GetObj(payload.Table, payload.Key)
+		if err != nil {
+			return err
 		}
-		payload := &DBMessage{}
-		if err := json.Unmarshal([]byte(data.Payload), payload); err != nil {
+		newdata, err := NewMessage("root", "gotObj", obj)
+		if err != nil {
 			return err
 		}
-		if _, exists := c.app.DBManager[payload.DB]; !exists {
-			return errors.New("Database does not exist.")
+		newdata.ID = data.ID
+		c.Send(newdata)
+		return nil
+	case "insertObj":
+		if err := db.InsertObj(payload.Table, payload.Key, obj); err != nil {
+			return err
 		}
-		if err := c.app.DBManager[payload.DB].DeleteObj(payload.Table, payload.Key); err != nil {
+	case "updateObj":
+		if err := db.UpdateObj(payload.Table, payload.Key, obj); err != nil {
 			return err
 		}
+	case "upsertObj":
+		if err := db.UpsertObj(payload.Table, payload.Key, obj); err != nil {
+			return err
+		}
+	case "deleteObj":
+		if err := db.DeleteObj(payload.Table, payload.Key); err != nil {
+			return err
+		}
+	case "subscribe", "unsubscribe":
+		c.Subscribe(data.Event == "subscribe", data.Room, payload)
+	}
+	if data.ID != "" {
+		c.SendResult(data, nil)
 	}
 	return nil
 }
 
-// ReadPump reads and parses incoming messages before passing them to HandleData.
+// ReadPump reads incoming text or binary frames and decodes them with the
+// connection's codec before passing them to HandleData.
+// Frames larger than the connection's read limit are discarded.
+// Such frames, frames that cannot be decoded and errors returned by
+// HandleData are logged and sent back as error events.
+// When the socket drops, the connection is parked for the resume grace
+// period, unless the client closed it normally, it sent a frame past the
+// read ceiling or it is closing; otherwise it is closed.
 func (c *Conn) ReadPump() {
+	c.mu.Lock()
+	socket, quit := c.socket, c.quit
+	c.mu.Unlock()
+	var err error
 	defer func() {
-		for _, room := range c.rooms {
-			room.leave <- c
+		socket.Close()
+		close(quit)
+		c.mu.Lock()
+		c.live = false
+		c.mu.Unlock()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) || err == websocket.ErrReadLimit || !c.park() {
+			c.Close()
 		}
-		c.socket.Close()
 	}()
-	c.socket.SetReadLimit(maxMessageSize)
-	c.socket.SetReadDeadline(time.Now().Add(pongWait))
-	c.socket.SetPongHandler(func(string) error {
-		c.socket.SetReadDeadline(time.Now().Add(pongWait))
+	socket.SetReadLimit(c.limits.readCeiling())
+	socket.SetReadDeadline(time.Now().Add(c.limits.PongWait))
+	socket.SetPongHandler(func(string) error {
+		socket.SetReadDeadline(time.Now().Add(c.limits.PongWait))
 		return nil
 	})
 	for {
-		data := &Message{}
-		if err := c.socket.ReadJSON(data); err != nil {
+		var frame []byte
+		frame, err = c.readFrame(socket)
+		if err == ErrMessageTooLarge {
+			log.Println("discarding incoming message:", err)
+			c.SendError(&Message{}, err)
+			continue
+		}
+		if err != nil {
 			if err != io.EOF {
-				log.Println("error parsing incoming message:", err)
+				log.Println("error reading incoming message:", err)
 			}
 			break
 		}
+		c.touchSession()
+		data := &Message{}
+		if err := c.codec.Decode(frame, data); err != nil {
+			log.Println("error parsing incoming message:", err)
+			c.SendError(data, NewError(ErrBadPayload.Code, err.Error()))
+			continue
+		}
 		if err := c.HandleData(data); err != nil {
 			log.Println(err)
+			c.SendError(data, err)
 		}
 	}
 }
 
+// readFrame reads the next text or binary frame from socket.
+// A frame larger than the read limit is read to its end and discarded,
+// so the connection stays usable, unless it passes the socket's read limit,
+// set by ReadPump to the limits' read ceiling.
+// It returns the frame, ErrMessageTooLarge, or an error from the connection.
+func (c *Conn) readFrame(socket *websocket.Conn) ([]byte, error) {
+	_, r, err := socket.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	frame, err := ioutil.ReadAll(io.LimitReader(r, c.limits.ReadLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(frame)) > c.limits.ReadLimit {
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return nil, err
+		}
+		return nil, ErrMessageTooLarge
+	}
+	return frame, nil
+}
+
 // Write writes a message with the given message type and payload to the WebSocket connection.
 func (c *Conn) Write(mt int, payload []byte) error {
-	c.socket.SetWriteDeadline(time.Now().Add(writeWait))
-	return c.socket.WriteMessage(mt, payload)
+	c.mu.Lock()
+	socket := c.socket
+	c.mu.Unlock()
+	return c.writeTo(socket, mt, payload)
 }
 
-// WritePump pumps messages from a room to the WebSocket connection.
+// writeTo writes a message with the given message type and payload to socket.
+func (c *Conn) writeTo(socket *websocket.Conn, mt int, payload []byte) error {
+	socket.SetWriteDeadline(time.Now().Add(c.limits.WriteWait))
+	return socket.WriteMessage(mt, payload)
+}
+
+// writeMessage encodes a message with the connection's codec and writes it to socket.
+// Messages that cannot be encoded are logged and dropped.
+func (c *Conn) writeMessage(socket *websocket.Conn, msg *Message) error {
+	data, err := c.codec.Encode(msg)
+	if err != nil {
+		log.Println("error encoding message: ", err)
+		return nil
+	}
+	mt := websocket.TextMessage
+	if c.codec.Binary() {
+		mt = websocket.BinaryMessage
+	}
+	return c.writeTo(socket, mt, data)
+}
+
+// WritePump pumps the messages queued for the connection to the WebSocket
+// connection, encoding them with the connection's codec, until the socket drops.
+// A message that could not be written is put back for the socket the
+// connection may be resumed with.
 func (c *Conn) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
+	c.mu.Lock()
+	socket, quit, written := c.socket, c.quit, c.written
+	c.mu.Unlock()
+	ticker := time.NewTicker(c.limits.PingPeriod)
 	defer func() {
 		ticker.Stop()
-		c.socket.Close()
+		socket.Close()
+		close(written)
 	}()
 	for {
-		select {
-		case msg, ok := <-c.send:
-			if !ok {
-				c.Write(websocket.CloseMessage, []byte{})
-				return
-			}
-			if err := c.Write(websocket.TextMessage, msg); err != nil {
+		for msg := c.out.pop(); msg != nil; msg = c.out.pop() {
+			if err := c.writeMessage(socket, msg); err != nil {
+				c.out.unpop(msg)
 				return
 			}
+		}
+		select {
+		case <-c.out.wake:
 		case <-ticker.C:
-			if err := c.Write(websocket.PingMessage, []byte{}); err != nil {
+			if err := c.writeTo(socket, websocket.PingMessage, []byte{}); err != nil {
 				return
 			}
+		case <-quit:
+			return
 		}
 	}
 }
 
-// Join will cause the WebSocket connection to join a room with name.
+// Join will cause the WebSocket connection to join a room with name,
+// regardless of the room's join policy.
+// A room destroyed while being joined is replaced by a new one.
 func (c *Conn) Join(name string) {
-	var room *Room
-	if _, ok := c.app.RoomManager[name]; ok {
-		room = c.app.RoomManager[name]
-	} else {
+	c.join(name, nil)
+}
+
+// JoinSince is like Join, but first sends the connection the messages of
+// the room's history whose sequence number is above since.
+func (c *Conn) JoinSince(name string, since uint64) {
+	c.join(name, &since)
+}
+
+// join makes the connection join a room, replaying its history above since
+// if since is not nil.
+func (c *Conn) join(name string, since *uint64) {
+	room := c.app.NewRoom(name)
+	for !room.joinSince(c, since) {
 		room = c.app.NewRoom(name)
 	}
-	room.Join(c)
+	c.roomsMu.Lock()
 	c.rooms[name] = room
+	c.roomsMu.Unlock()
+}
+
+// room returns the room with name if the connection is a member of it.
+// It is safe to call from any goroutine, as are Join and Leave.
+func (c *Conn) room(name string) (*Room, bool) {
+	c.roomsMu.RLock()
+	defer c.roomsMu.RUnlock()
+	room, ok := c.rooms[name]
+	return room, ok
 }
 
 // Leave removes the WebSocket connection from a room with name.
 func (c *Conn) Leave(name string) {
-	if room, ok := c.app.RoomManager[name]; ok {
+	c.roomsMu.Lock()
+	room, ok := c.rooms[name]
+	delete(c.rooms, name)
+	c.roomsMu.Unlock()
+	if ok {
 		room.Leave(c)
-		delete(c.rooms, room.name)
 	}
 }
 
+// Send sends a message to this connection only.
+// It does not block; see push.
+func (c *Conn) Send(payload *Message) {
+	c.push(payload)
+}
+
+// SendError sends an error event about a received message to this connection only.
+// The payload is the error converted with AsError, naming the event and id
+// of the message; the error event carries the message's id as well.
+func (c *Conn) SendError(data *Message, err error) {
+	e := AsError(err)
+	e.Event = data.Event
+	e.ID = data.ID
+	payload, merr := json.Marshal(e)
+	if merr != nil {
+		log.Println(merr)
+		return
+	}
+	c.Send(&Message{
+		Room:    "root",
+		Event:   "error",
+		ID:      data.ID,
+		Payload: payload,
+	})
+}
+
 // Emit sends a message to all connections in a room specified in payload.
-func (c *Conn) Emit(payload *Message) {
-	if room, ok := c.app.RoomManager[payload.Room]; ok {
-		room.Emit(payload)
+// The connection must be a member of the room.
+// It returns ErrNotMember otherwise.
+func (c *Conn) Emit(payload *Message) error {
+	room, ok := c.room(payload.Room)
+	if !ok {
+		return ErrNotMember
+	}
+	room.Emit(payload)
+	return nil
+}
+
+// Subscribe binds the table or object named in payload to the room specified
+// by name, or to the connection itself if name is "root", so that changes
+// to it are pushed as objInserted, objUpdated and objDeleted messages.
+// The connection must be a member of the room.
+// If subscribe is false, the binding is removed instead.
+func (c *Conn) Subscribe(subscribe bool, name string, payload *DBMessage) {
+	subs := c.app.Subscriptions
+	if name == "root" || name == "" {
+		if subscribe {
+			subs.SubscribeConn(c, payload.DB, payload.Table, payload.Key)
+		} else {
+			subs.UnsubscribeConn(c, payload.DB, payload.Table, payload.Key)
+		}
+		return
+	}
+	if _, ok := c.room(name); !ok {
+		return
+	}
+	if subscribe {
+		subs.SubscribeRoom(name, payload.DB, payload.Table, payload.Key)
+	} else {
+		subs.UnsubscribeRoom(name, payload.DB, payload.Table, payload.Key)
 	}
 }
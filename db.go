@@ -17,220 +17,150 @@
 package rtgo
 
 import (
-	"database/sql"
-	"encoding/json"
-	"errors"
-	"fmt"
-	_ "github.com/go-sql-driver/mysql"
-	_ "github.com/lib/pq"
-	_ "github.com/mattn/go-sqlite3"
-	"github.com/tpjg/goriakpbc"
 	"log"
 	"strings"
 )
 
 type Database struct {
-	app        *App
-	name       string
-	params     map[string]string
-	buckets    map[string]*riak.Bucket
-	dsn        string
-	create     string
-	connection *sql.DB
+	app    *App
+	name   string
+	params map[string]string
+	store  Store
+}
+
+// Store returns the storage backend of the database.
+func (db *Database) Store() Store {
+	return db.store
 }
 
 // GetAllObjs selects all rows and columns in a database table.
 // It returns an array of interfaces or an error.
 func (db *Database) GetAllObjs(table string) ([]interface{}, error) {
-	data := make([]interface{}, 0)
-	if db.name == "riak" {
-		if _, exists := db.buckets[table]; !exists {
-			return nil, errors.New("Bucket does not exist.")
-		}
-		keys, err := db.buckets[table].ListKeys()
-		if err != nil {
-			return nil, err
-		}
-		for _, key := range keys {
-			collect := make(map[string]interface{})
-			obj, err := db.GetObj(table, string(key))
-			if err != nil {
-				return nil, err
-			}
-			collect["hash"] = string(key)
-			collect["data"] = obj
-			data = append(data, collect)
-		}
-	} else {
-		query := fmt.Sprintf("SELECT * FROM %s", table)
-		rows, err := db.connection.Query(query)
-		if err != nil {
-			return nil, err
-		}
-		cols, err := rows.Columns()
-		if err != nil {
-			return nil, err
-		}
-		blobs := make([][]byte, len(cols))
-		dest := make([]interface{}, len(cols))
-		for i := range cols {
-			dest[i] = &blobs[i]
-		}
-		for rows.Next() {
-			if err := rows.Scan(dest...); err != nil {
-				return nil, err
-			}
-			collect := make(map[string]interface{})
-			for i, blob := range blobs {
-				var value interface{}
-				col := cols[i]
-				if col == "hash" {
-					value = string(blob)
-				} else if err := json.Unmarshal(blob, &value); err != nil {
-					return nil, err
-				}
-				collect[col] = value
-			}
-			data = append(data, collect)
-		}
-	}
-	return data, nil
+	return db.store.GetAllObjs(table)
 }
 
 // GetObj selects data from a table with the matching key.
 // It returns an interface or an error.
 func (db *Database) GetObj(table string, key string) (interface{}, error) {
-	var data interface{}
-	if db.name == "riak" {
-		if _, exists := db.buckets[table]; !exists {
-			return nil, errors.New("Bucket does not exist.")
-		}
-		if exists, _ := db.buckets[table].Exists(key); !exists {
-			return nil, errors.New("Object does not exist.")
-		}
-		obj, err := db.buckets[table].Get(key)
-		if err != nil {
-			return nil, err
-		}
-		if err := json.Unmarshal(obj.Data, &data); err != nil {
-			return nil, err
-		}
-	} else {
-		query := ""
-		blob := make([]byte, 0)
-		if db.name == "postgres" {
-			query = fmt.Sprintf("SELECT data FROM %s WHERE hash = $1", table)
-		} else {
-			query = fmt.Sprintf("SELECT data FROM %s WHERE hash = ?", table)
-		}
-		if err := db.connection.QueryRow(query, key).Scan(&blob); err != nil {
-			return nil, err
-		}
-		if err := json.Unmarshal(blob, &data); err != nil {
-			return nil, err
-		}
-	}
-	return data, nil
+	return db.store.GetObj(table, key)
 }
 
 // DeleteObj deletes a row from a database table with a matching key.
 // It may return an error.
 func (db *Database) DeleteObj(table string, key string) error {
-	if db.name == "riak" {
-		if _, exists := db.buckets[table]; !exists {
-			return errors.New("Bucket does not exist.")
-		}
-		if err := db.buckets[table].Delete(key); err != nil {
-			return err
-		}
-	} else {
-		query := ""
-		if db.name == "postgres" {
-			query = fmt.Sprintf("DELETE FROM %s WHERE hash = $1", table)
-		} else {
-			query = fmt.Sprintf("DELETE FROM %s WHERE hash = ?", table)
-		}
-		if _, err := db.connection.Exec(query, key); err != nil {
-			return err
-		}
+	if err := db.store.DeleteObj(table, key); err != nil {
+		return err
 	}
+	db.publish("objDeleted", table, key, nil)
 	return nil
 }
 
 // InsertObj inserts data into a database table with the specified key.
 // It may return an error.
 func (db *Database) InsertObj(table string, key string, data interface{}) error {
-	blob, err := json.Marshal(&data)
-	if err != nil {
+	if err := db.store.InsertObj(table, key, data); err != nil {
 		return err
 	}
-	if db.name == "riak" {
-		if _, exists := db.buckets[table]; !exists {
-			return errors.New("Bucket does not exist.")
-		}
-		obj := db.buckets[table].NewObject(key)
-		obj.ContentType = "application/json"
-		obj.Data = blob
-		if err = obj.Store(); err != nil {
-			return err
-		}
-	} else {
-		query := ""
-		if db.name == "postgres" {
-			query = fmt.Sprintf("INSERT INTO %s (hash, data) VALUES ($1, $2)", table)
-		} else {
-			query = fmt.Sprintf("INSERT INTO %s (hash, data) VALUES (?, ?)", table)
-		}
-		if _, err := db.connection.Exec(query, key, blob); err != nil {
-			return err
-		}
+	db.publish("objInserted", table, key, data)
+	return nil
+}
+
+// UpdateObj replaces the data of an existing row in a database table
+// with the specified key.
+// It may return an error.
+func (db *Database) UpdateObj(table string, key string, data interface{}) error {
+	if err := db.store.UpdateObj(table, key, data); err != nil {
+		return err
+	}
+	db.publish("objUpdated", table, key, data)
+	return nil
+}
+
+// UpsertObj inserts data into a database table with the specified key,
+// replacing the data of any existing row.
+// It may return an error.
+func (db *Database) UpsertObj(table string, key string, data interface{}) error {
+	if err := db.store.UpsertObj(table, key, data); err != nil {
+		return err
 	}
+	db.publish("objUpdated", table, key, data)
 	return nil
 }
 
+// QueryObjs selects the rows in a database table matching q.
+// It returns an array of interfaces or an error.
+func (db *Database) QueryObjs(table string, q *Query) ([]interface{}, error) {
+	return db.store.QueryObjs(table, q)
+}
+
+// publish notifies the subscribers of a table or object of a change.
+// Upserts are published as objUpdated.
+func (db *Database) publish(event string, table string, key string, data interface{}) {
+	if db.app == nil || db.app.Subscriptions == nil {
+		return
+	}
+	db.app.Subscriptions.Publish(db.app, event, &Change{
+		DB:    db.name,
+		Table: table,
+		Key:   key,
+		Data:  data,
+	})
+}
+
 // Start starts the database and initializes its tables/buckets.
 // If a users table is not specified in the config.json file,
 // one is created anyways.
 func (db *Database) Start() {
-	usersTableExists := false
-	if db.name == "riak" {
-		if err := riak.ConnectClient(db.dsn); err != nil {
-			log.Fatal("Cannot connect, is Riak running?")
-		}
-		tableList := strings.Split(db.params["tables"], ",")
-		for _, bname := range tableList {
-			if bname == "users" {
-				usersTableExists = true
-			}
-			db.buckets[bname], _ = riak.NewBucket(bname)
-		}
-		if usersTableExists == false {
-			db.buckets["users"], _ = riak.NewBucket("users")
-		}
-	} else {
-		dbconn, err := sql.Open(db.name, db.dsn)
-		if err != nil {
-			log.Fatal(err)
-		}
-		db.connection = dbconn
-		if _, exists := db.params["tables"]; !exists {
-			return
+	if err := db.store.Start(db.tables()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Stop stops the database.
+// It may return an error.
+func (db *Database) Stop() error {
+	return db.store.Stop()
+}
+
+// HasTable reports whether table is listed in config.json or is the users
+// table, the tables clients may name in their messages. The sessions and
+// history tables are kept for rtgo's own use.
+func (db *Database) HasTable(table string) bool {
+	if table == "users" {
+		return true
+	}
+	if db.params["tables"] == "" {
+		return false
+	}
+	for _, name := range strings.Split(db.params["tables"], ",") {
+		if name == table {
+			return true
 		}
-		tableList := strings.Split(db.params["tables"], ",")
-		for _, table := range tableList {
+	}
+	return false
+}
+
+// tables returns the tables listed in config.json plus the users table
+// and, if the database keeps the sessions, the sessions table.
+func (db *Database) tables() []string {
+	tableList := make([]string, 0)
+	usersTableExists := false
+	if db.params["tables"] != "" {
+		for _, table := range strings.Split(db.params["tables"], ",") {
 			if table == "users" {
 				usersTableExists = true
 			}
-			statement := fmt.Sprintf(db.create, table)
-			if _, err := db.connection.Exec(statement); err != nil {
-				log.Fatal(err)
-			}
-		}
-		if usersTableExists == false {
-			statement := fmt.Sprintf(db.create, "users")
-			if _, err := db.connection.Exec(statement); err != nil {
-				log.Fatal(err)
-			}
+			tableList = append(tableList, table)
 		}
 	}
+	if usersTableExists == false {
+		tableList = append(tableList, "users")
+	}
+	if db.app != nil && db.app.Sessions["db"] == db.name {
+		tableList = append(tableList, db.app.sessionTable())
+	}
+	if db.app != nil {
+		tableList = append(tableList, db.app.historyTables(db.name)...)
+	}
+	return tableList
 }
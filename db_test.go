@@ -0,0 +1,57 @@
+//    Title: db_test.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestHandleDBDataTable(t *testing.T) {
+	app := newTestApp(t, `, "roles": {"guest": ["getObj:*"]}`)
+	ws := dialTestApp(t, app)
+	readUntil(t, ws, "join")
+	tables := []string{"test; DROP TABLE users", app.sessionTable()}
+	for i, table := range tables {
+		payload, _ := json.Marshal(map[string]string{"db": "memory", "table": table, "key": "a"})
+		if err := ws.WriteJSON(&Message{Room: "root", Event: "getObj", ID: strconv.Itoa(i), Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+		reply := readUntil(t, ws, "error")
+		var e Error
+		if err := json.Unmarshal(reply.Payload, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Code != ErrTableNotFound.Code {
+			t.Errorf("getObj on %q: got %s", table, reply.Payload)
+		}
+	}
+}
+
+func TestCheckTable(t *testing.T) {
+	for _, table := range []string{"users", "rtgo_history", "_t1"} {
+		if err := checkTable(table); err != nil {
+			t.Errorf("checkTable(%q) = %v", table, err)
+		}
+	}
+	for _, table := range []string{"", "1t", "a b", "t;--", "t`", `t"`} {
+		if err := checkTable(table); err == nil {
+			t.Errorf("checkTable(%q) succeeded", table)
+		}
+	}
+}
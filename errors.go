@@ -0,0 +1,95 @@
+//    Title: errors.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// Error is an error reported to a client in an error event.
+// Code is a stable, machine readable identifier while Message is meant for humans.
+// Event and ID identify the message that caused the error and are filled in
+// when the error is sent.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Event   string `json:"event,omitempty"`
+	ID      string `json:"id,omitempty"`
+}
+
+// The errors reported by rtgo itself.
+var (
+	ErrPermissionDenied = NewError("permissionDenied", "Permission denied.")
+	ErrDatabaseNotFound = NewError("databaseNotFound", "Database does not exist.")
+	ErrTableNotFound    = NewError("tableNotFound", "Table does not exist.")
+	ErrObjectNotFound   = NewError("objectNotFound", "Object does not exist.")
+	ErrObjectExists     = NewError("objectExists", "Object already exists.")
+	ErrBadPayload       = NewError("badPayload", "Invalid payload.")
+	ErrMessageTooLarge  = NewError("messageTooLarge", "Message too large.")
+	ErrStreamRefused    = NewError("streamRefused", "Stream refused.")
+	ErrStreamAborted    = NewError("streamAborted", "Stream aborted.")
+	ErrTooManyStreams   = NewError("tooManyStreams", "Too many streams.")
+	ErrNotMember        = NewError("notMember", "Not a member of the room.")
+	ErrJoinDenied       = NewError("joinDenied", "Not allowed to join the room.")
+	ErrTooManyAttempts  = NewError("tooManyAttempts", "Too many attempts, try again later.")
+	ErrInternal         = NewError("internal", "Internal error.")
+)
+
+// NewError creates an error with a code and a message.
+// Application handlers may return it to control the error event sent to the client.
+// It returns the new error.
+func NewError(code string, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+// Error returns the message of the error.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is an *Error with the same code,
+// so errors.Is(err, ErrPermissionDenied) holds for copies of ErrPermissionDenied.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// AsError converts any error into an *Error.
+// JSON decoding errors become ErrBadPayload; other errors that are not
+// an *Error become ErrInternal, and their text, which may name tables,
+// files or driver details, is only logged.
+// It returns a copy that may be modified freely.
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		copied := *e
+		return &copied
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return NewError(ErrBadPayload.Code, err.Error())
+	}
+	log.Println("internal error:", err)
+	copied := *ErrInternal
+	return &copied
+}
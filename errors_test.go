@@ -0,0 +1,39 @@
+//    Title: errors_test.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestAsError(t *testing.T) {
+	e := AsError(errors.New(`pq: relation "secret" does not exist`))
+	if e.Code != ErrInternal.Code || e.Message != ErrInternal.Message {
+		t.Errorf("internal error sent as %+v", e)
+	}
+	var v struct{}
+	if e := AsError(json.Unmarshal([]byte("{"), &v)); e.Code != ErrBadPayload.Code {
+		t.Errorf("JSON error sent as %+v", e)
+	}
+	e = AsError(ErrNotMember)
+	e.Event = "emit"
+	if ErrNotMember.Event != "" || e.Code != ErrNotMember.Code {
+		t.Errorf("got %+v, ErrNotMember is %+v", e, ErrNotMember)
+	}
+}
@@ -0,0 +1,252 @@
+//    Title: history.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// historyEntry is a message kept in the history table of a database.
+type historyEntry struct {
+	Room    string   `json:"room"`
+	Seq     uint64   `json:"seq"`
+	Message *Message `json:"message"`
+}
+
+// history is a ring buffer holding the last messages emitted in a room.
+type history struct {
+	messages []*Message
+	next     int
+	full     bool
+}
+
+// newHistory creates a history keeping size messages.
+func newHistory(size int) *history {
+	return &history{messages: make([]*Message, size)}
+}
+
+// add keeps m, dropping the oldest message if the history is full.
+func (h *history) add(m *Message) {
+	h.messages[h.next] = m
+	h.next = (h.next + 1) % len(h.messages)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// since returns the messages kept whose sequence number is above seq,
+// oldest first.
+func (h *history) since(seq uint64) []*Message {
+	messages := make([]*Message, 0)
+	start, count := 0, h.next
+	if h.full {
+		start, count = h.next, len(h.messages)
+	}
+	for i := 0; i < count; i++ {
+		m := h.messages[(start+i)%len(h.messages)]
+		if m.Seq > seq {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// History returns the messages kept in the history of the room whose
+// sequence number is above since, oldest first.
+func (r *Room) History(since uint64) []*Message {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.history == nil {
+		return nil
+	}
+	return r.history.since(since)
+}
+
+// openHistory sets up the history of the room from the rooms block of
+// config.json, loading the last messages from the history table if any.
+// It must be called from the room's goroutine.
+func (r *Room) openHistory() {
+	size := r.app.HistorySize(r.name)
+	if size == 0 {
+		return
+	}
+	r.history = newHistory(size)
+	r.historyDB, r.historyTable = r.app.historyStore(r.name)
+	if r.historyDB == nil {
+		return
+	}
+	objs, err := r.historyDB.QueryObjs(r.historyTable, &Query{
+		Filters: []Filter{{Field: "room", Op: "=", Value: r.name}},
+		Sort:    []Order{{Field: "seq", Desc: true}},
+		Limit:   size,
+	})
+	if err != nil {
+		log.Println("error loading the history of room", r.name+":", err)
+		return
+	}
+	for i := len(objs) - 1; i >= 0; i-- {
+		entry, err := decodeHistoryEntry(objs[i])
+		if err != nil {
+			log.Println("error loading the history of room", r.name+":", err)
+			continue
+		}
+		r.history.add(entry.Message)
+	}
+}
+
+// decodeHistoryEntry decodes an object of a history table, as returned by
+// Store.QueryObjs.
+// It returns the entry or an error.
+func decodeHistoryEntry(obj interface{}) (*historyEntry, error) {
+	collect, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid history entry")
+	}
+	raw, err := json.Marshal(collect["data"])
+	if err != nil {
+		return nil, err
+	}
+	entry := &historyEntry{}
+	if err := json.Unmarshal(raw, entry); err != nil {
+		return nil, err
+	}
+	if entry.Message == nil {
+		return nil, fmt.Errorf("invalid history entry")
+	}
+	entry.Message.Seq = entry.Seq
+	return entry, nil
+}
+
+// record keeps a message emitted in the room in its history.
+// Messages without a sequence number, delivered while the broker was
+// unavailable, are not kept.
+// It must be called from the room's goroutine.
+func (r *Room) record(m *Message) {
+	if r.history == nil || m.Seq == 0 {
+		return
+	}
+	r.mu.Lock()
+	r.history.add(m)
+	r.mu.Unlock()
+	if r.historyDB == nil {
+		return
+	}
+	key := r.name + "/" + strconv.FormatUint(m.Seq, 10)
+	entry := &historyEntry{Room: r.name, Seq: m.Seq, Message: m}
+	if err := r.historyDB.UpsertObj(r.historyTable, key, entry); err != nil {
+		log.Println("error saving the history of room", r.name+":", err)
+		return
+	}
+	r.historyDirty = true
+}
+
+// trimHistory deletes the messages of the history table beyond the size
+// of the room's history.
+// It must be called from the room's goroutine.
+func (r *Room) trimHistory() {
+	if r.historyDB == nil || !r.historyDirty {
+		return
+	}
+	r.historyDirty = false
+	objs, err := r.historyDB.QueryObjs(r.historyTable, &Query{
+		Filters: []Filter{{Field: "room", Op: "=", Value: r.name}},
+		Sort:    []Order{{Field: "seq", Desc: true}},
+		Offset:  len(r.history.messages),
+	})
+	if err != nil {
+		log.Println("error trimming the history of room", r.name+":", err)
+		return
+	}
+	for _, obj := range objs {
+		collect, ok := obj.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if key, ok := collect["hash"].(string); ok {
+			if err := r.historyDB.DeleteObj(r.historyTable, key); err != nil {
+				log.Println("error trimming the history of room", r.name+":", err)
+			}
+		}
+	}
+}
+
+// roomParam returns the value of a field for the room named name: the
+// field of the entry named after the room in the rooms block of
+// config.json, or else of its default entry.
+func (a *App) roomParam(name string, field string) (string, bool) {
+	if val, ok := a.Rooms[name][field]; ok {
+		return val, true
+	}
+	val, ok := a.Rooms["default"][field]
+	return val, ok
+}
+
+// HistorySize returns the number of messages kept in the history of the
+// room named name, 0 if it keeps none.
+func (a *App) HistorySize(name string) int {
+	val, ok := a.roomParam(name, "history")
+	if !ok {
+		return 0
+	}
+	size, err := strconv.Atoi(val)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
+}
+
+// historyStore returns the store and table holding the history of the room
+// named name, or a nil store if its history is kept in memory only.
+func (a *App) historyStore(name string) (Store, string) {
+	dbname, ok := a.roomParam(name, "historydb")
+	if !ok || dbname == "" {
+		return nil, ""
+	}
+	db, ok := a.DBManager[dbname]
+	if !ok {
+		log.Println("The history database does not exist:", dbname)
+		return nil, ""
+	}
+	table, _ := a.roomParam(name, "historytable")
+	if table == "" {
+		table = "history"
+	}
+	return db.Store(), table
+}
+
+// historyTables returns the history tables kept in the database named dbname.
+func (a *App) historyTables(dbname string) []string {
+	tables := make([]string, 0)
+	seen := make(map[string]bool)
+	for name := range a.Rooms {
+		if db, _ := a.roomParam(name, "historydb"); db != dbname {
+			continue
+		}
+		table, _ := a.roomParam(name, "historytable")
+		if table == "" {
+			table = "history"
+		}
+		if !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
@@ -0,0 +1,93 @@
+//    Title: hooks.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"sync"
+)
+
+// hooks holds the functions registered on an app to follow the
+// lifecycle of its rooms.
+type hooks struct {
+	mu          sync.RWMutex
+	roomCreate  []func(*Room)
+	roomEmpty   []func(*Room)
+	roomDestroy []func(*Room)
+	join        []func(*Room, *Conn)
+	leave       []func(*Room, *Conn)
+}
+
+// Hooks run synchronously in the goroutine of the room they are about,
+// in the order they were registered, so they must not block, nor join,
+// leave or emit to that room.
+
+// OnRoomCreate registers fn to be called when a room is created.
+func (a *App) OnRoomCreate(fn func(r *Room)) {
+	a.hooks.mu.Lock()
+	defer a.hooks.mu.Unlock()
+	a.hooks.roomCreate = append(a.hooks.roomCreate, fn)
+}
+
+// OnRoomEmpty registers fn to be called when the last member leaves a room,
+// which starts its grace period.
+func (a *App) OnRoomEmpty(fn func(r *Room)) {
+	a.hooks.mu.Lock()
+	defer a.hooks.mu.Unlock()
+	a.hooks.roomEmpty = append(a.hooks.roomEmpty, fn)
+}
+
+// OnRoomDestroy registers fn to be called when a room is stopped and removed.
+func (a *App) OnRoomDestroy(fn func(r *Room)) {
+	a.hooks.mu.Lock()
+	defer a.hooks.mu.Unlock()
+	a.hooks.roomDestroy = append(a.hooks.roomDestroy, fn)
+}
+
+// OnJoin registers fn to be called when a connection joins a room.
+func (a *App) OnJoin(fn func(r *Room, c *Conn)) {
+	a.hooks.mu.Lock()
+	defer a.hooks.mu.Unlock()
+	a.hooks.join = append(a.hooks.join, fn)
+}
+
+// OnLeave registers fn to be called when a connection leaves a room,
+// or is removed from it.
+func (a *App) OnLeave(fn func(r *Room, c *Conn)) {
+	a.hooks.mu.Lock()
+	defer a.hooks.mu.Unlock()
+	a.hooks.leave = append(a.hooks.leave, fn)
+}
+
+// runRoom calls every hook in fns with r.
+func (h *hooks) runRoom(fns *[]func(*Room), r *Room) {
+	h.mu.RLock()
+	list := *fns
+	h.mu.RUnlock()
+	for _, fn := range list {
+		fn(r)
+	}
+}
+
+// runConn calls every hook in fns with r and c.
+func (h *hooks) runConn(fns *[]func(*Room, *Conn), r *Room, c *Conn) {
+	h.mu.RLock()
+	list := *fns
+	h.mu.RUnlock()
+	for _, fn := range list {
+		fn(r, c)
+	}
+}
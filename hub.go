@@ -0,0 +1,159 @@
+//    Title: hub.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"sync"
+)
+
+// Hub keeps the open connections and the running rooms of an app.
+// It is safe for concurrent use; connections are added when they are
+// opened and removed when they close.
+type Hub struct {
+	app    *App
+	mu     sync.RWMutex
+	conns  map[string]*Conn
+	rooms  map[string]*Room
+	tokens map[string]*Conn
+}
+
+// NewHub creates an empty hub for app.
+// It returns the new hub.
+func NewHub(app *App) *Hub {
+	return &Hub{
+		app:    app,
+		conns:  make(map[string]*Conn),
+		rooms:  make(map[string]*Room),
+		tokens: make(map[string]*Conn),
+	}
+}
+
+// AddConn adds an open connection.
+func (h *Hub) AddConn(c *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.conns[c.id] = c
+}
+
+// RemoveConn removes a closed connection.
+func (h *Hub) RemoveConn(c *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[c.id] == c {
+		delete(h.conns, c.id)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" {
+		delete(h.tokens, c.token)
+		c.token = ""
+	}
+}
+
+// Conn returns the open connection with id.
+// It returns false if there is none.
+func (h *Hub) Conn(id string) (*Conn, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	c, ok := h.conns[id]
+	return c, ok
+}
+
+// Conns returns a snapshot of the open connections.
+func (h *Hub) Conns() []*Conn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	conns := make([]*Conn, 0, len(h.conns))
+	for _, c := range h.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Room returns the running room named name.
+// It returns false if there is none.
+func (h *Hub) Room(name string) (*Room, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	r, ok := h.rooms[name]
+	return r, ok
+}
+
+// Rooms returns a snapshot of the running rooms.
+func (h *Hub) Rooms() []*Room {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, r := range h.rooms {
+		rooms = append(rooms, r)
+	}
+	return rooms
+}
+
+// OpenRoom returns the running room named name, creating and starting it
+// if there is none.
+// Until it is joined, a new room is kept running for its grace period only.
+func (h *Hub) OpenRoom(name string) *Room {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if r, ok := h.rooms[name]; ok {
+		return r
+	}
+	r := &Room{
+		app:     h.app,
+		name:    name,
+		members: make(map[*Conn]*Member),
+		remote:  make(map[string]*remoteNode),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan bool),
+		join:    make(chan joinRequest),
+		leave:   make(chan *Conn),
+		state:   make(chan memberState),
+		send:    make(chan *Message, 256),
+		done:    make(chan struct{}),
+	}
+	go r.Start()
+	h.rooms[name] = r
+	return r
+}
+
+// closeRoom removes a room being destroyed, unless another room
+// with its name has replaced it.
+func (h *Hub) closeRoom(r *Room) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rooms[r.name] == r {
+		delete(h.rooms, r.name)
+	}
+}
+
+// Conns returns a snapshot of the app's open connections.
+func (a *App) Conns() []*Conn {
+	return a.Hub.Conns()
+}
+
+// ConnByID returns the app's open connection with id.
+// It returns false if there is none.
+func (a *App) ConnByID(id string) (*Conn, bool) {
+	return a.Hub.Conn(id)
+}
+
+// Room returns the app's running room named name.
+// It returns false if there is none.
+func (a *App) Room(name string) (*Room, bool) {
+	return a.Hub.Room(name)
+}
@@ -0,0 +1,132 @@
+//    Title: keys.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/securecookie"
+	"io/ioutil"
+	"os"
+)
+
+// CookieKey is a pair of base64 encoded keys used to sign and encrypt cookies.
+// Hash should be 32 or 64 bytes long; Block, if set, must be 16, 24 or 32
+// bytes long to select AES-128, AES-192 or AES-256.
+type CookieKey struct {
+	Hash  string `json:"hash"`
+	Block string `json:"block,omitempty"`
+}
+
+// GenerateCookieKey creates a CookieKey from random bytes.
+// It returns the new key or an error.
+func GenerateCookieKey() (CookieKey, error) {
+	hashKey := securecookie.GenerateRandomKey(64)
+	blockKey := securecookie.GenerateRandomKey(32)
+	if hashKey == nil || blockKey == nil {
+		return CookieKey{}, errors.New("Could not generate a cookie key.")
+	}
+	return CookieKey{
+		Hash:  base64.StdEncoding.EncodeToString(hashKey),
+		Block: base64.StdEncoding.EncodeToString(blockKey),
+	}, nil
+}
+
+// ReadKeyFile reads the JSON list of cookie keys in path, newest first.
+// A missing file holds no keys.
+// It returns the keys or an error.
+func ReadKeyFile(path string) ([]CookieKey, error) {
+	file, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	keys := make([]CookieKey, 0)
+	if err := json.Unmarshal(file, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// WriteKeyFile writes a JSON list of cookie keys to path, readable by its owner only.
+// It may return an error.
+func WriteKeyFile(path string, keys []CookieKey) error {
+	file, err := json.MarshalIndent(keys, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, file, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// RotateKeyFile adds a new key to the front of the key file in path,
+// creating the file if needed, and keeps at most keep keys.
+// Cookies signed with the dropped keys no longer validate.
+// It returns the new list of keys or an error.
+func RotateKeyFile(path string, keep int) ([]CookieKey, error) {
+	if keep < 1 {
+		return nil, errors.New("At least one key must be kept.")
+	}
+	keys, err := ReadKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := GenerateCookieKey()
+	if err != nil {
+		return nil, err
+	}
+	keys = append([]CookieKey{key}, keys...)
+	if len(keys) > keep {
+		keys = keys[:keep]
+	}
+	if err := WriteKeyFile(path, keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// NewCodecs creates a securecookie codec per key.
+// Cookies are encoded with the first codec and decoded with any of them.
+// It returns the codecs or an error.
+func NewCodecs(keys []CookieKey) ([]securecookie.Codec, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("No cookie keys.")
+	}
+	pairs := make([][]byte, 0, len(keys)*2)
+	for _, key := range keys {
+		hashKey, err := base64.StdEncoding.DecodeString(key.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if len(hashKey) == 0 {
+			return nil, errors.New("Cookie keys must have a hash key.")
+		}
+		var blockKey []byte
+		if key.Block != "" {
+			if blockKey, err = base64.StdEncoding.DecodeString(key.Block); err != nil {
+				return nil, err
+			}
+		}
+		pairs = append(pairs, hashKey, blockKey)
+	}
+	return securecookie.CodecsFromPairs(pairs...), nil
+}
@@ -0,0 +1,147 @@
+//    Title: keys_test.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestReadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := ReadKeyFile(filepath.Join(dir, "missing.json"))
+	if err != nil || len(keys) != 0 {
+		t.Errorf("missing file: got %v, %v", keys, err)
+	}
+	invalid := filepath.Join(dir, "invalid.json")
+	os.WriteFile(invalid, []byte(`{"hash": "a"}`), 0600)
+	if _, err := ReadKeyFile(invalid); err == nil {
+		t.Error("reading a file that is not a list succeeded")
+	}
+}
+
+func TestRotateKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if _, err := RotateKeyFile(path, 0); err == nil {
+		t.Error("keeping no key succeeded")
+	}
+	var history [][]CookieKey
+	for i := 0; i < 3; i++ {
+		keys, err := RotateKeyFile(path, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		history = append(history, keys)
+	}
+	if len(history[0]) != 1 || len(history[1]) != 2 || len(history[2]) != 2 {
+		t.Fatalf("got %d, %d and %d keys, want 1, 2 and 2", len(history[0]), len(history[1]), len(history[2]))
+	}
+	if history[1][1] != history[0][0] || history[2][1] != history[1][0] || history[2][0] == history[1][0] {
+		t.Error("new keys are not added in front of the kept ones")
+	}
+	read, err := ReadKeyFile(path)
+	if err != nil || !reflect.DeepEqual(read, history[2]) {
+		t.Errorf("key file holds %v, %v", read, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestCodecsOlderKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	old, err := RotateKeyFile(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codecs, err := NewCodecs(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := securecookie.EncodeMulti("rtgo", map[string]string{"session": "abc"}, codecs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := RotateKeyFile(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codecs, err = NewCodecs(rotated); err != nil {
+		t.Fatal(err)
+	}
+	value := make(map[string]string)
+	if err := securecookie.DecodeMulti("rtgo", cookie, &value, codecs...); err != nil || value["session"] != "abc" {
+		t.Errorf("cookie signed with the older key not decoded: %v, %v", value, err)
+	}
+	fresh, err := securecookie.EncodeMulti("rtgo", value, codecs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCodecs, _ := NewCodecs(old)
+	if err := securecookie.DecodeMulti("rtgo", fresh, &value, oldCodecs...); err == nil {
+		t.Error("cookies still encoded with the older key")
+	}
+	dropped, err := RotateKeyFile(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codecs, _ = NewCodecs(dropped)
+	if err := securecookie.DecodeMulti("rtgo", cookie, &value, codecs...); err == nil {
+		t.Error("cookie signed with a dropped key decoded")
+	}
+}
+
+func TestNewCodecsInvalid(t *testing.T) {
+	invalid := [][]CookieKey{
+		nil,
+		{{Hash: "not base64!"}},
+		{{Hash: ""}},
+		{{Hash: "aGFzaA==", Block: "not base64!"}},
+	}
+	for _, keys := range invalid {
+		if _, err := NewCodecs(keys); err == nil {
+			t.Errorf("NewCodecs(%v) succeeded", keys)
+		}
+	}
+}
+
+func TestAppKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys, err := RotateKeyFile(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(t, fmt.Sprintf(`, "keyfile": %q`, path))
+	codecs, _ := NewCodecs(keys)
+	cookie, err := securecookie.EncodeMulti("rtgo", map[string]string{"session": "abc"}, codecs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := make(map[string]string)
+	if err := securecookie.DecodeMulti("rtgo", cookie, &value, app.Codecs...); err != nil {
+		t.Errorf("app does not use the key file: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+//    Title: limits.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Limits tunes a WebSocket connection.
+// ReadLimit is the size in bytes of the largest message accepted; larger
+// messages are discarded and answered with an ErrMessageTooLarge error event,
+// up to discardFactor times ReadLimit, beyond which the connection is closed.
+// WriteWait is the time allowed to write a message, PongWait the time allowed
+// to receive the next pong, and PingPeriod the interval between pings, which
+// must be shorter than PongWait.
+// SendBuffer is the number of messages queued for the connection, and
+// Overflow what is done with a message sent while SendBuffer messages are queued.
+// Streams is the number of streams the connection may send at once; more
+// are refused with an ErrTooManyStreams error.
+type Limits struct {
+	ReadLimit  int64
+	WriteWait  time.Duration
+	PongWait   time.Duration
+	PingPeriod time.Duration
+	SendBuffer int
+	Overflow   Overflow
+	Streams    int
+}
+
+// discardFactor is how many times the read limit a message may be and still
+// be discarded rather than have its connection closed.
+const discardFactor = 16
+
+// readCeiling returns the size in bytes of the largest message read from
+// the wire, past which the connection is closed.
+func (l Limits) readCeiling() int64 {
+	if l.ReadLimit > math.MaxInt64/discardFactor {
+		return math.MaxInt64
+	}
+	return l.ReadLimit * discardFactor
+}
+
+// DefaultLimits are the limits of connections for which config.json sets none.
+var DefaultLimits = Limits{
+	ReadLimit:  64 * 1024,
+	WriteWait:  10 * time.Second,
+	PongWait:   60 * time.Second,
+	PingPeriod: 54 * time.Second,
+	SendBuffer: 256,
+	Overflow:   Disconnect,
+	Streams:    8,
+}
+
+// With returns the limits with the fields set in params overridden:
+// readlimit, sendbuffer and streams are integers, writewait, pongwait and
+// pingperiod are durations and overflow names an overflow policy.
+// If pongwait is set without pingperiod, the ping period becomes
+// nine tenths of the pong wait.
+// It returns the new limits or an error.
+func (l Limits) With(params map[string]string) (Limits, error) {
+	var err error
+	if val, ok := params["readlimit"]; ok {
+		if l.ReadLimit, err = strconv.ParseInt(val, 10, 64); err != nil {
+			return l, err
+		}
+	}
+	if val, ok := params["sendbuffer"]; ok {
+		if l.SendBuffer, err = strconv.Atoi(val); err != nil {
+			return l, err
+		}
+	}
+	if val, ok := params["streams"]; ok {
+		if l.Streams, err = strconv.Atoi(val); err != nil {
+			return l, err
+		}
+	}
+	if val, ok := params["overflow"]; ok {
+		l.Overflow = Overflow(val)
+	}
+	durations := map[string]*time.Duration{
+		"writewait":  &l.WriteWait,
+		"pongwait":   &l.PongWait,
+		"pingperiod": &l.PingPeriod,
+	}
+	for name, field := range durations {
+		if val, ok := params[name]; ok {
+			if *field, err = time.ParseDuration(val); err != nil {
+				return l, err
+			}
+		}
+	}
+	if _, ok := params["pingperiod"]; !ok {
+		if _, ok := params["pongwait"]; ok {
+			l.PingPeriod = (l.PongWait * 9) / 10
+		}
+	}
+	return l, l.Validate()
+}
+
+// Validate checks that the limits can be used by a connection.
+// It returns an error if any are out of range.
+func (l Limits) Validate() error {
+	switch {
+	case l.ReadLimit <= 0:
+		return fmt.Errorf("readlimit must be positive, got %d", l.ReadLimit)
+	case l.SendBuffer <= 0:
+		return fmt.Errorf("sendbuffer must be positive, got %d", l.SendBuffer)
+	case l.Streams <= 0:
+		return fmt.Errorf("streams must be positive, got %d", l.Streams)
+	case l.WriteWait <= 0 || l.PongWait <= 0 || l.PingPeriod <= 0:
+		return fmt.Errorf("writewait, pongwait and pingperiod must be positive")
+	case l.PingPeriod >= l.PongWait:
+		return fmt.Errorf("pingperiod %s must be shorter than pongwait %s", l.PingPeriod, l.PongWait)
+	}
+	return checkOverflow(l.Overflow)
+}
+
+// checkLimits validates the limits block of config.json, applying
+// every override on top of the default entry.
+// It returns an error if any entry is invalid.
+func (a *App) checkLimits() error {
+	base, err := DefaultLimits.With(a.Limits["default"])
+	if err != nil {
+		return fmt.Errorf("limits default: %v", err)
+	}
+	for name, params := range a.Limits {
+		if _, err := base.With(params); err != nil {
+			return fmt.Errorf("limits %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// ConnLimits returns the limits of a connection opened on the socket
+// handler mounted at path by a user with role.
+// The default entry of the limits block in config.json is overridden by the
+// entry named after path, which in turn is overridden by the "role:<role>" entry;
+// connections without a session have the guest role. An override conflicting
+// with the ones before it is logged and ignored.
+func (a *App) ConnLimits(path string, role string) Limits {
+	if role == "" {
+		role = "guest"
+	}
+	limits := DefaultLimits
+	for _, name := range []string{"default", path, "role:" + role} {
+		params, ok := a.Limits[name]
+		if !ok {
+			continue
+		}
+		l, err := limits.With(params)
+		if err != nil {
+			log.Println("ignoring limits", name+":", err)
+			continue
+		}
+		limits = l
+	}
+	return limits
+}
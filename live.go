@@ -0,0 +1,206 @@
+//    Title: live.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// Change describes an object that was inserted, updated or deleted.
+// It is the payload of the objInserted, objUpdated and objDeleted events.
+type Change struct {
+	DB    string      `json:"db"`
+	Table string      `json:"table"`
+	Key   string      `json:"key"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// Subscriptions binds rooms and connections to database tables or objects
+// so that they are sent a message whenever one of those changes.
+// Subscriptions are kept per instance and changes are not carried by the
+// broker, so only the subscribers of the instance making a change see it.
+type Subscriptions struct {
+	mu    sync.RWMutex
+	rooms map[string]map[string]bool
+	conns map[string]map[*Conn]bool
+}
+
+// NewSubscriptions creates an empty set of subscriptions.
+// It returns the new subscriptions.
+func NewSubscriptions() *Subscriptions {
+	return &Subscriptions{
+		rooms: make(map[string]map[string]bool),
+		conns: make(map[string]map[*Conn]bool),
+	}
+}
+
+// topic returns the name under which subscribers to a table,
+// or to a single object if key is not empty, are kept.
+func topic(db string, table string, key string) string {
+	if key == "" {
+		return db + "/" + table
+	}
+	return db + "/" + table + "/" + key
+}
+
+// SubscribeRoom binds a room to a table, or to a single object if key is not empty.
+func (s *Subscriptions) SubscribeRoom(room string, db string, table string, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := topic(db, table, key)
+	if _, ok := s.rooms[t]; !ok {
+		s.rooms[t] = make(map[string]bool)
+	}
+	s.rooms[t][room] = true
+}
+
+// UnsubscribeRoom removes a binding made with SubscribeRoom.
+func (s *Subscriptions) UnsubscribeRoom(room string, db string, table string, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := topic(db, table, key)
+	delete(s.rooms[t], room)
+	if len(s.rooms[t]) == 0 {
+		delete(s.rooms, t)
+	}
+}
+
+// SubscribeConn binds a connection to a table, or to a single object if key is not empty.
+func (s *Subscriptions) SubscribeConn(c *Conn, db string, table string, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := topic(db, table, key)
+	if _, ok := s.conns[t]; !ok {
+		s.conns[t] = make(map[*Conn]bool)
+	}
+	s.conns[t][c] = true
+}
+
+// UnsubscribeConn removes a binding made with SubscribeConn.
+func (s *Subscriptions) UnsubscribeConn(c *Conn, db string, table string, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := topic(db, table, key)
+	delete(s.conns[t], c)
+	if len(s.conns[t]) == 0 {
+		delete(s.conns, t)
+	}
+}
+
+// RemoveRoom removes every binding of a room.
+func (s *Subscriptions) RemoveRoom(room string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t, rooms := range s.rooms {
+		delete(rooms, room)
+		if len(rooms) == 0 {
+			delete(s.rooms, t)
+		}
+	}
+}
+
+// RemoveConn removes every binding of a connection.
+func (s *Subscriptions) RemoveConn(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t, conns := range s.conns {
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(s.conns, t)
+		}
+	}
+}
+
+// subscribers returns the rooms and connections bound to either
+// the table or the object of a change.
+func (s *Subscriptions) subscribers(change *Change) ([]string, []*Conn) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rooms := make([]string, 0)
+	conns := make([]*Conn, 0)
+	seenRooms := make(map[string]bool)
+	seenConns := make(map[*Conn]bool)
+	for _, t := range []string{topic(change.DB, change.Table, ""), topic(change.DB, change.Table, change.Key)} {
+		for room := range s.rooms[t] {
+			if !seenRooms[room] {
+				seenRooms[room] = true
+				rooms = append(rooms, room)
+			}
+		}
+		for c := range s.conns[t] {
+			if !seenConns[c] {
+				seenConns[c] = true
+				conns = append(conns, c)
+			}
+		}
+	}
+	return rooms, conns
+}
+
+// livePermission returns the permission a member needs to receive data:
+// getObj:<db>:<table> for the changes sent by Publish, or "" for
+// any other message.
+func livePermission(data *Message) string {
+	switch data.Event {
+	case "objInserted", "objUpdated", "objDeleted":
+	default:
+		return ""
+	}
+	change := &struct {
+		DB    string `json:"db"`
+		Table string `json:"table"`
+	}{}
+	if err := json.Unmarshal(data.Payload, change); err != nil {
+		return ""
+	}
+	return "getObj:" + change.DB + ":" + change.Table
+}
+
+// Publish sends a change to every room and connection bound to it.
+// Rooms receive the message through Room.Emit, and only their members
+// allowed to get objects from the table are sent it; connections receive
+// it in the root room.
+func (s *Subscriptions) Publish(app *App, event string, change *Change) {
+	rooms, conns := s.subscribers(change)
+	if len(rooms) == 0 && len(conns) == 0 {
+		return
+	}
+	payload, err := json.Marshal(change)
+	if err != nil {
+		log.Println("error encoding change: ", err)
+		return
+	}
+	for _, name := range rooms {
+		if room, ok := app.Room(name); ok {
+			room.Emit(&Message{
+				Room:    name,
+				Event:   event,
+				Payload: payload,
+			})
+		}
+	}
+	data := &Message{
+		Room:    "root",
+		Event:   event,
+		Payload: payload,
+	}
+	for _, c := range conns {
+		c.push(data)
+	}
+}
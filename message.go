@@ -16,19 +16,99 @@
 
 package rtgo
 
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+)
+
 // Message defines the structure of incoming JSON messages
 // that do not perform DB functions.
+// ID is set by clients expecting a reply; replies carry the same ID.
+// Payload holds any JSON value; use Decode to read it.
+// Data holds an optional binary attachment, sent as is by the binary codecs
+// and base64 encoded by the JSON codec.
+// Seq is the sequence number of a message emitted in a room; it increases
+// with every message of the room, though not necessarily by one.
 type Message struct {
-	Room    string `json:"room"`
-	Event   string `json:"event"`
-	Payload string `json:"payload"`
+	Room    string          `json:"room"`
+	Event   string          `json:"event"`
+	ID      string          `json:"id,omitempty"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+	Data    []byte          `json:"data,omitempty"`
 }
 
 // DBMessage defines the structure of incoming JSON messages
 // that do perform DB function.
 type DBMessage struct {
-	DB    string `json:"db"`
-	Table string `json:"table"`
-	Key   string `json:"key"`
-	Data  string `json:"data"`
+	DB    string          `json:"db"`
+	Table string          `json:"table"`
+	Key   string          `json:"key"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// NewMessage creates a message with a JSON encoded payload.
+// It returns the new message or an error.
+func NewMessage(room string, event string, payload interface{}) (*Message, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		Room:    room,
+		Event:   event,
+		Payload: raw,
+	}, nil
+}
+
+// rawPayload JSON encodes a payload that is known to be encodable,
+// such as a string. It logs and returns null on failure.
+func rawPayload(payload interface{}) json.RawMessage {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("error encoding payload: ", err)
+		return json.RawMessage("null")
+	}
+	return raw
+}
+
+// DecodePayload decodes a JSON payload into v.
+// For clients that still encode their payloads as strings, a string holding
+// a JSON object or array is decoded as that object or array, unless v is a *string.
+// It may return an error.
+func DecodePayload(raw json.RawMessage, v interface{}) error {
+	if _, ok := v.(*string); !ok && len(raw) > 0 && raw[0] == '"' {
+		var str string
+		if err := json.Unmarshal(raw, &str); err == nil {
+			trimmed := bytes.TrimSpace([]byte(str))
+			if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+				raw = json.RawMessage(trimmed)
+			}
+		}
+	}
+	if len(raw) == 0 {
+		raw = json.RawMessage("null")
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// Decode decodes the payload of the message into v.
+// It may return an error.
+func (m *Message) Decode(v interface{}) error {
+	return DecodePayload(m.Payload, v)
+}
+
+// On registers a listener on the app's Emitter for event whose payload is
+// decoded into a T before being passed to fn. Payloads that cannot be decoded
+// are answered with an error event.
+func On[T any](a *App, event string, fn func(*Conn, T)) {
+	a.Emitter.On(event, func(c *Conn, data *Message) {
+		var payload T
+		if err := data.Decode(&payload); err != nil {
+			c.SendError(data, NewError(ErrBadPayload.Code, err.Error()))
+			return
+		}
+		fn(c, payload)
+	})
 }
@@ -0,0 +1,282 @@
+//    Title: migrate.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// The name of the table recording the applied migrations.
+	migrationsTable = "rtgo_migrations"
+	// The file names of migrations: <version>_<name>.up.sql or <version>_<name>.down.sql.
+	migrationregex = regexp.MustCompile("^([0-9]+)_([A-Za-z0-9_-]+)\\.(up|down)\\.sql$")
+)
+
+// SQLBackend is implemented by stores built on database/sql,
+// which makes them usable by the migrations runner.
+type SQLBackend interface {
+	// DB returns the open database handle.
+	DB() *sql.DB
+	// Dialect returns the name of the database/sql driver.
+	Dialect() string
+}
+
+// Migration is a versioned change to the schema of a SQL database.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus reports whether a migration has been applied.
+type MigrationStatus struct {
+	Migration
+	Applied bool
+}
+
+// LoadMigrations reads the migrations for a dialect from dir/<dialect>.
+// A missing directory holds no migrations.
+// It returns the migrations ordered by version or an error.
+func LoadMigrations(dir string, dialect string) ([]Migration, error) {
+	files, err := ioutil.ReadDir(filepath.Join(dir, dialect))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, file := range files {
+		match := migrationregex.FindStringSubmatch(file.Name())
+		if file.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(dir, dialect, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("Migration %d has two names: %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("Migration %d_%s has no up file.", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// sqlBackend returns the database's store as a SQLBackend.
+func (db *Database) sqlBackend() (SQLBackend, error) {
+	backend, ok := db.store.(SQLBackend)
+	if !ok {
+		return nil, fmt.Errorf("Database %s does not support migrations.", db.name)
+	}
+	return backend, nil
+}
+
+// appliedMigrations creates the bookkeeping table if needed and
+// reads the versions of the applied migrations.
+func appliedMigrations(backend SQLBackend) (map[int64]bool, error) {
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied VARCHAR(64) NOT NULL)", migrationsTable)
+	if _, err := backend.DB().Exec(create); err != nil {
+		return nil, err
+	}
+	rows, err := backend.DB().Query(fmt.Sprintf("SELECT version FROM %s", migrationsTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int64]bool)
+	for rows.Next() {
+		var version int64
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// MigrationStatus lists the migrations in dir for the database's dialect.
+// It returns the status of every migration or an error.
+func (db *Database) MigrationStatus(dir string) ([]MigrationStatus, error) {
+	backend, err := db.sqlBackend()
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := LoadMigrations(dir, backend.Dialect())
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(backend)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status = append(status, MigrationStatus{Migration: m, Applied: applied[m.Version]})
+	}
+	return status, nil
+}
+
+// MigrateUp applies every pending migration in dir, in order of version.
+// Each migration runs in its own transaction together with its bookkeeping,
+// except that MySQL commits DDL statements such as CREATE or ALTER TABLE
+// implicitly, so a failing MySQL migration may be partly applied.
+// It returns the applied migrations or an error.
+func (db *Database) MigrateUp(dir string) ([]Migration, error) {
+	status, err := db.MigrationStatus(dir)
+	if err != nil {
+		return nil, err
+	}
+	backend, _ := db.sqlBackend()
+	done := make([]Migration, 0)
+	for _, s := range status {
+		if s.Applied {
+			continue
+		}
+		record := rebind(backend.Dialect(), fmt.Sprintf("INSERT INTO %s (version, name, applied) VALUES (?, ?, ?)", migrationsTable))
+		if err := runMigration(backend, s.Up, record, s.Version, s.Name, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			return done, fmt.Errorf("Migration %d_%s failed: %s", s.Version, s.Name, err)
+		}
+		done = append(done, s.Migration)
+	}
+	return done, nil
+}
+
+// MigrateDown reverts the last steps applied migrations in dir, newest first.
+// It returns the reverted migrations or an error.
+func (db *Database) MigrateDown(dir string, steps int) ([]Migration, error) {
+	status, err := db.MigrationStatus(dir)
+	if err != nil {
+		return nil, err
+	}
+	backend, _ := db.sqlBackend()
+	done := make([]Migration, 0)
+	for i := len(status) - 1; i >= 0 && len(done) < steps; i-- {
+		s := status[i]
+		if !s.Applied {
+			continue
+		}
+		if s.Down == "" {
+			return done, fmt.Errorf("Migration %d_%s has no down file.", s.Version, s.Name)
+		}
+		record := rebind(backend.Dialect(), fmt.Sprintf("DELETE FROM %s WHERE version = ?", migrationsTable))
+		if err := runMigration(backend, s.Down, record, s.Version); err != nil {
+			return done, fmt.Errorf("Migration %d_%s failed: %s", s.Version, s.Name, err)
+		}
+		done = append(done, s.Migration)
+	}
+	return done, nil
+}
+
+// runMigration executes script and the bookkeeping statement record in a transaction.
+// The MySQL driver executes one statement at a time, so MySQL scripts are
+// split into statements first.
+func runMigration(backend SQLBackend, script string, record string, args ...interface{}) error {
+	if script == "" {
+		return errors.New("Empty migration.")
+	}
+	statements := []string{script}
+	if backend.Dialect() == "mysql" {
+		statements = splitStatements(script)
+	}
+	tx, err := backend.DB().Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// splitStatements splits a SQL script on the semicolons ending its statements,
+// ignoring those in quoted strings, quoted identifiers and comments.
+// It returns the statements, without blank ones.
+func splitStatements(script string) []string {
+	var statements []string
+	start := 0
+	add := func(end int) {
+		if statement := strings.TrimSpace(script[start:end]); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	for i := 0; i < len(script); i++ {
+		switch ch := script[i]; {
+		case ch == '\'' || ch == '"' || ch == '`':
+			for i++; i < len(script) && script[i] != ch; i++ {
+				if script[i] == '\\' && ch != '`' {
+					i++
+				}
+			}
+		case ch == '#' || (ch == '-' && strings.HasPrefix(script[i:], "-- ")):
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+		case ch == '/' && strings.HasPrefix(script[i:], "/*"):
+			if end := strings.Index(script[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(script)
+			}
+		case ch == ';':
+			add(i)
+			start = i + 1
+		}
+	}
+	add(len(script))
+	return statements
+}
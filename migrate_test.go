@@ -0,0 +1,38 @@
+//    Title: migrate_test.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	script := "CREATE TABLE a (x TEXT DEFAULT 'a;b');\n" +
+		"-- comment; not a statement\n" +
+		"# another; comment\n" +
+		"/* block; comment */ INSERT INTO a VALUES (\"c\\\";d\");\n" +
+		"ALTER TABLE `we;ird` ADD y INT;\n\n"
+	want := []string{
+		"CREATE TABLE a (x TEXT DEFAULT 'a;b')",
+		"-- comment; not a statement\n# another; comment\n/* block; comment */ INSERT INTO a VALUES (\"c\\\";d\")",
+		"ALTER TABLE `we;ird` ADD y INT",
+	}
+	if got := splitStatements(script); !reflect.DeepEqual(got, want) {
+		t.Errorf("splitStatements() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,235 @@
+//    Title: outbox.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// Overflow names what is done with a message sent to a connection
+// whose send buffer is full.
+type Overflow string
+
+// The overflow policies.
+const (
+	// DropOldest drops the oldest queued message to make room.
+	DropOldest Overflow = "dropoldest"
+	// DropNewest drops the message being sent.
+	DropNewest Overflow = "dropnewest"
+	// Coalesce drops the oldest queued message with the room and event of
+	// the message being sent, or the oldest queued message if there is none.
+	// Replies to calls are never coalesced.
+	Coalesce Overflow = "coalesce"
+	// Disconnect closes the connection.
+	Disconnect Overflow = "disconnect"
+)
+
+// checkOverflow reports whether o names an overflow policy.
+// It returns an error otherwise.
+func checkOverflow(o Overflow) error {
+	switch o {
+	case DropOldest, DropNewest, Coalesce, Disconnect:
+		return nil
+	}
+	return fmt.Errorf("unknown overflow policy %q", o)
+}
+
+// DropStats counts, across the connections of an app, the messages dropped
+// by each overflow policy and the connections closed for being too slow.
+type DropStats struct {
+	Oldest      uint64 `json:"oldest"`
+	Newest      uint64 `json:"newest"`
+	Coalesced   uint64 `json:"coalesced"`
+	Disconnects uint64 `json:"disconnects"`
+}
+
+// drops holds the counters of an app's DropStats.
+type drops struct {
+	oldest      atomic.Uint64
+	newest      atomic.Uint64
+	coalesced   atomic.Uint64
+	disconnects atomic.Uint64
+}
+
+// DropStats returns the number of messages dropped so far because
+// connections were too slow to receive them.
+func (a *App) DropStats() DropStats {
+	return DropStats{
+		Oldest:      a.drops.oldest.Load(),
+		Newest:      a.drops.newest.Load(),
+		Coalesced:   a.drops.coalesced.Load(),
+		Disconnects: a.drops.disconnects.Load(),
+	}
+}
+
+// queued is a message waiting in an outbox. Kept messages are never dropped.
+type queued struct {
+	msg  *Message
+	keep bool
+}
+
+// outbox queues the messages sent to a connection until its WritePump
+// writes them, holding at most size of them that may be dropped.
+// wake is signalled without blocking whenever a message is queued.
+type outbox struct {
+	mu       sync.Mutex
+	msgs     []queued
+	size     int
+	overflow Overflow
+	closed   bool
+	dropped  uint64
+	wake     chan struct{}
+}
+
+// newOutbox creates an empty outbox.
+// It returns the new outbox.
+func newOutbox(size int, overflow Overflow) *outbox {
+	return &outbox{
+		size:     size,
+		overflow: overflow,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// push queues a message, applying the overflow policy when the outbox is
+// full unless the message is kept. Messages pushed to a closed outbox are
+// discarded.
+// It returns the policy that was applied, or an empty string if nothing was
+// dropped. Disconnect closes the outbox.
+func (o *outbox) push(msg *Message, keep bool) Overflow {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return ""
+	}
+	applied := Overflow("")
+	if !keep && o.droppable() >= o.size {
+		applied = o.overflow
+		switch o.overflow {
+		case Disconnect:
+			o.closed = true
+			o.msgs = nil
+			return Disconnect
+		case DropNewest:
+			o.dropped++
+			return DropNewest
+		case Coalesce:
+			if !o.evict(func(q queued) bool {
+				return msg.ID == "" && q.msg.ID == "" && q.msg.Room == msg.Room && q.msg.Event == msg.Event
+			}) {
+				applied = DropOldest
+				o.evict(nil)
+			}
+		case DropOldest:
+			o.evict(nil)
+		}
+		o.dropped++
+	}
+	o.msgs = append(o.msgs, queued{msg: msg, keep: keep})
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return applied
+}
+
+// droppable returns the number of queued messages that may be dropped.
+func (o *outbox) droppable() int {
+	n := 0
+	for _, q := range o.msgs {
+		if !q.keep {
+			n++
+		}
+	}
+	return n
+}
+
+// evict removes the oldest queued message that may be dropped and matches,
+// if match is set.
+// It returns false if there is none.
+func (o *outbox) evict(match func(queued) bool) bool {
+	for i, q := range o.msgs {
+		if q.keep || (match != nil && !match(q)) {
+			continue
+		}
+		o.msgs = append(o.msgs[:i], o.msgs[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// pop removes the oldest queued message.
+// It returns nil if there is none.
+func (o *outbox) pop() *Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.msgs) == 0 {
+		return nil
+	}
+	q := o.msgs[0]
+	o.msgs[0] = queued{}
+	o.msgs = o.msgs[1:]
+	return q.msg
+}
+
+// unpop puts back a message that could not be written in front of the queue,
+// where it is never dropped.
+func (o *outbox) unpop(msg *Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.msgs = append([]queued{{msg: msg, keep: true}}, o.msgs...)
+}
+
+// close discards the queued messages and the ones pushed later.
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	o.msgs = nil
+}
+
+// push queues a message for the connection without blocking. When its send
+// buffer is full, the overflow policy of its limits drops a message or
+// closes the connection.
+func (c *Conn) push(msg *Message) {
+	switch c.out.push(msg, false) {
+	case DropOldest:
+		c.app.drops.oldest.Add(1)
+	case DropNewest:
+		c.app.drops.newest.Add(1)
+	case Coalesce:
+		c.app.drops.coalesced.Add(1)
+	case Disconnect:
+		c.app.drops.disconnects.Add(1)
+		log.Println("disconnecting slow connection: ", c.id)
+		go c.Close()
+	}
+}
+
+// Dropped returns the number of messages sent to the connection that its
+// overflow policy dropped.
+func (c *Conn) Dropped() uint64 {
+	c.out.mu.Lock()
+	defer c.out.mu.Unlock()
+	return c.out.dropped
+}
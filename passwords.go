@@ -0,0 +1,343 @@
+//    Title: passwords.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+func init() {
+	RegisterHasher("bcrypt", newBcryptHasher)
+	RegisterHasher("scrypt", newScryptHasher)
+	RegisterHasher("argon2id", newArgon2idHasher)
+}
+
+// PasswordHasher hashes and verifies passwords.
+// Encoded hashes record the algorithm and its parameters, so any hash can
+// be verified regardless of the parameters the hasher was created with.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of password.
+	Hash(password string) (string, error)
+	// Verify reports whether password matches the encoded hash.
+	Verify(password string, encoded string) (bool, error)
+	// NeedsRehash reports whether encoded was produced with another
+	// algorithm or other parameters than the hasher's.
+	NeedsRehash(encoded string) bool
+}
+
+// HasherFactory creates a PasswordHasher from the passwords block of config.json.
+// Missing parameters take their default values.
+type HasherFactory func(params map[string]string) (PasswordHasher, error)
+
+var (
+	hashersMu sync.RWMutex
+	hashers   = make(map[string]HasherFactory)
+)
+
+// RegisterHasher makes a password hashing algorithm available under name.
+// Encoded hashes produced by the hasher must start with "$" + name + "$".
+// It panics if factory is nil or if RegisterHasher is called twice with the same name.
+func RegisterHasher(name string, factory HasherFactory) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+	if factory == nil {
+		panic("rtgo: RegisterHasher factory is nil")
+	}
+	if _, dup := hashers[name]; dup {
+		panic("rtgo: RegisterHasher called twice for hasher " + name)
+	}
+	hashers[name] = factory
+}
+
+// NewPasswordHasher creates the hasher named by params["algorithm"],
+// or a bcrypt hasher if no algorithm is given.
+// It returns the new hasher or an error.
+func NewPasswordHasher(params map[string]string) (PasswordHasher, error) {
+	name := params["algorithm"]
+	if name == "" {
+		name = "bcrypt"
+	}
+	hashersMu.RLock()
+	factory, ok := hashers[name]
+	hashersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Password hasher %s is not registered.", name)
+	}
+	return factory(params)
+}
+
+// hashAlgorithm returns the name of the algorithm that produced an encoded hash.
+func hashAlgorithm(encoded string) string {
+	if strings.HasPrefix(encoded, "$2") {
+		return "bcrypt"
+	}
+	fields := strings.SplitN(encoded, "$", 3)
+	if len(fields) < 3 || fields[0] != "" {
+		return ""
+	}
+	return fields[1]
+}
+
+// VerifyPassword reports whether password matches an encoded hash
+// produced by any registered hasher.
+// It may return an error.
+func VerifyPassword(password string, encoded string) (bool, error) {
+	h, err := NewPasswordHasher(map[string]string{"algorithm": hashAlgorithm(encoded)})
+	if err != nil {
+		return false, err
+	}
+	return h.Verify(password, encoded)
+}
+
+// legacyPasshash returns the hash stored by versions of rtgo that hashed
+// the concatenation of username, email, password and salt with SHA-256.
+func legacyPasshash(username string, email string, password string, salt string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(username+email+password+salt)))
+}
+
+// intParam parses params[name], or returns def if it is not set.
+func intParam(params map[string]string, name string, def int) (int, error) {
+	val, ok := params[name]
+	if !ok || val == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid password hasher parameter %s: %s", name, val)
+	}
+	return n, nil
+}
+
+// randomSalt returns n random bytes.
+func randomSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// b64 is the unpadded base64 encoding used by the encoded hashes.
+var b64 = base64.RawStdEncoding
+
+// BcryptHasher hashes passwords with bcrypt.
+// Its encoded hashes use the standard $2a$ format.
+type BcryptHasher struct {
+	Cost int
+}
+
+// newBcryptHasher creates a BcryptHasher with params["cost"].
+func newBcryptHasher(params map[string]string) (PasswordHasher, error) {
+	cost, err := intParam(params, "cost", bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return &BcryptHasher{Cost: cost}, nil
+}
+
+// Hash returns the encoded hash of password.
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+// Verify reports whether password matches the encoded hash.
+func (h *BcryptHasher) Verify(password string, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NeedsRehash reports whether encoded is not a bcrypt hash of the hasher's cost.
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// ScryptHasher hashes passwords with scrypt.
+// Its encoded hashes look like $scrypt$ln=15,r=8,p=1$<salt>$<hash>,
+// where ln is the base 2 logarithm of the CPU/memory cost.
+type ScryptHasher struct {
+	LogN   int
+	R      int
+	P      int
+	KeyLen int
+}
+
+// newScryptHasher creates a ScryptHasher with params["ln"], params["r"] and params["p"].
+func newScryptHasher(params map[string]string) (PasswordHasher, error) {
+	h := &ScryptHasher{KeyLen: 32}
+	var err error
+	if h.LogN, err = intParam(params, "ln", 15); err != nil {
+		return nil, err
+	}
+	if h.R, err = intParam(params, "r", 8); err != nil {
+		return nil, err
+	}
+	if h.P, err = intParam(params, "p", 1); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Hash returns the encoded hash of password.
+func (h *ScryptHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<uint(h.LogN), h.R, h.P, h.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.LogN, h.R, h.P, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// decode parses an encoded scrypt hash.
+func (h *ScryptHasher) decode(encoded string) (*ScryptHasher, []byte, []byte, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 5 || fields[1] != "scrypt" {
+		return nil, nil, nil, errors.New("Invalid scrypt hash.")
+	}
+	params := &ScryptHasher{}
+	if _, err := fmt.Sscanf(fields[2], "ln=%d,r=%d,p=%d", &params.LogN, &params.R, &params.P); err != nil {
+		return nil, nil, nil, errors.New("Invalid scrypt hash.")
+	}
+	salt, err := b64.DecodeString(fields[3])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := b64.DecodeString(fields[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	params.KeyLen = len(key)
+	return params, salt, key, nil
+}
+
+// Verify reports whether password matches the encoded hash.
+func (h *ScryptHasher) Verify(password string, encoded string) (bool, error) {
+	params, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key([]byte(password), salt, 1<<uint(params.LogN), params.R, params.P, params.KeyLen)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash reports whether encoded is not a scrypt hash of the hasher's parameters.
+func (h *ScryptHasher) NeedsRehash(encoded string) bool {
+	params, _, _, err := h.decode(encoded)
+	return err != nil || *params != *h
+}
+
+// Argon2idHasher hashes passwords with Argon2id.
+// Its encoded hashes use the standard $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash> format.
+type Argon2idHasher struct {
+	Memory  int
+	Time    int
+	Threads int
+	KeyLen  int
+}
+
+// newArgon2idHasher creates an Argon2idHasher with params["memory"] (in KiB),
+// params["time"] and params["threads"].
+func newArgon2idHasher(params map[string]string) (PasswordHasher, error) {
+	h := &Argon2idHasher{KeyLen: 32}
+	var err error
+	if h.Memory, err = intParam(params, "memory", 64*1024); err != nil {
+		return nil, err
+	}
+	if h.Time, err = intParam(params, "time", 3); err != nil {
+		return nil, err
+	}
+	if h.Threads, err = intParam(params, "threads", 2); err != nil {
+		return nil, err
+	}
+	if h.Threads > 255 {
+		return nil, errors.New("Argon2id supports at most 255 threads.")
+	}
+	return h, nil
+}
+
+// Hash returns the encoded hash of password.
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, uint32(h.Time), uint32(h.Memory), uint8(h.Threads), uint32(h.KeyLen))
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Time, h.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// decode parses an encoded Argon2id hash.
+func (h *Argon2idHasher) decode(encoded string) (*Argon2idHasher, []byte, []byte, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 6 || fields[1] != "argon2id" {
+		return nil, nil, nil, errors.New("Invalid argon2id hash.")
+	}
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errors.New("Unsupported argon2id version.")
+	}
+	params := &Argon2idHasher{}
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, errors.New("Invalid argon2id hash.")
+	}
+	salt, err := b64.DecodeString(fields[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := b64.DecodeString(fields[5])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	params.KeyLen = len(key)
+	return params, salt, key, nil
+}
+
+// Verify reports whether password matches the encoded hash.
+func (h *Argon2idHasher) Verify(password string, encoded string) (bool, error) {
+	params, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, uint32(params.Time), uint32(params.Memory), uint8(params.Threads), uint32(params.KeyLen))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash reports whether encoded is not an Argon2id hash of the hasher's parameters.
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, _, _, err := h.decode(encoded)
+	return err != nil || *params != *h
+}
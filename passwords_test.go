@@ -0,0 +1,190 @@
+//    Title: passwords_test.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Cheap parameters for each hasher, so that tests run fast.
+var testHashers = []map[string]string{
+	{"algorithm": "bcrypt", "cost": "4"},
+	{"algorithm": "scrypt", "ln": "4", "r": "8", "p": "1"},
+	{"algorithm": "argon2id", "memory": "64", "time": "1", "threads": "1"},
+}
+
+func TestHasherRoundTrip(t *testing.T) {
+	for _, params := range testHashers {
+		h, err := NewPasswordHasher(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := h.Hash("correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hashAlgorithm(encoded) != params["algorithm"] {
+			t.Errorf("%s hash %q names algorithm %q", params["algorithm"], encoded, hashAlgorithm(encoded))
+		}
+		if ok, err := VerifyPassword("correct horse", encoded); !ok || err != nil {
+			t.Errorf("%s: right password refused: %v", params["algorithm"], err)
+		}
+		if ok, err := VerifyPassword("battery staple", encoded); ok || err != nil {
+			t.Errorf("%s: wrong password accepted: %v", params["algorithm"], err)
+		}
+		if h.NeedsRehash(encoded) {
+			t.Errorf("%s: own hash needs a rehash", params["algorithm"])
+		}
+		if other, _ := h.Hash("correct horse"); other == encoded {
+			t.Errorf("%s: hashes are not salted", params["algorithm"])
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	changed := []map[string]string{
+		{"algorithm": "bcrypt", "cost": "5"},
+		{"algorithm": "scrypt", "ln": "5", "r": "8", "p": "1"},
+		{"algorithm": "argon2id", "memory": "64", "time": "2", "threads": "1"},
+	}
+	for _, params := range testHashers {
+		h, _ := NewPasswordHasher(params)
+		encoded, err := h.Hash("secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, other := range changed {
+			o, err := NewPasswordHasher(other)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !o.NeedsRehash(encoded) {
+				t.Errorf("%v does not rehash a hash made with %v", other, params)
+			}
+		}
+	}
+}
+
+func TestPasswordHasherParams(t *testing.T) {
+	invalid := []map[string]string{
+		{"algorithm": "md5"},
+		{"algorithm": "bcrypt", "cost": "high"},
+		{"algorithm": "scrypt", "ln": "0"},
+		{"algorithm": "argon2id", "threads": "256"},
+	}
+	for _, params := range invalid {
+		if _, err := NewPasswordHasher(params); err == nil {
+			t.Errorf("NewPasswordHasher(%v) succeeded", params)
+		}
+	}
+	h, err := NewPasswordHasher(map[string]string{"algorithm": "argon2id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *h.(*Argon2idHasher) != (Argon2idHasher{Memory: 64 * 1024, Time: 3, Threads: 2, KeyLen: 32}) {
+		t.Errorf("default argon2id parameters: %+v", h)
+	}
+	malformed := []string{
+		"",
+		"$scrypt$ln=4$c2FsdA$a2V5",
+		"$scrypt$ln=4,r=8,p=1$not base64!$a2V5",
+		"$argon2id$v=18$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64$c2FsdA$a2V5",
+		"$2a$04$short",
+	}
+	for _, encoded := range malformed {
+		if ok, err := VerifyPassword("secret", encoded); ok || err == nil {
+			t.Errorf("VerifyPassword(%q) = %v, %v", encoded, ok, err)
+		}
+	}
+}
+
+// postLogin posts a login form to app with a fresh session's cookie
+// and CSRF token.
+// It returns the response status.
+func postLogin(t *testing.T, app *App, username string, password string) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s, err := app.StartSession(rec, httptest.NewRequest("GET", "/", nil), "", "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("username", username)
+	form.WriteField("password", password)
+	form.Close()
+	req := httptest.NewRequest("POST", "/login", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("X-CSRF-Token", s.CSRF)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	rec = httptest.NewRecorder()
+	app.LoginHandler(rec, req)
+	return rec.Code
+}
+
+func TestLoginRehash(t *testing.T) {
+	app := newTestApp(t, `, "passwords": {"algorithm": "bcrypt", "cost": "4"}`)
+	old, _ := NewPasswordHasher(testHashers[1])
+	passhash, err := old.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := app.DBManager["memory"]
+	user := map[string]interface{}{
+		"username": "alice",
+		"passhash": passhash,
+		"role":     map[string]interface{}{"privilege": "user"},
+	}
+	if err := db.InsertObj("users", "alice", user); err != nil {
+		t.Fatal(err)
+	}
+	if code := postLogin(t, app, "alice", "wrong"); code == http.StatusOK {
+		t.Fatal("login with a wrong password succeeded")
+	}
+	if got := storedPasshash(t, db); got != passhash {
+		t.Fatalf("failed login rehashed the password: %s", got)
+	}
+	if code := postLogin(t, app, "alice", "secret"); code != http.StatusOK {
+		t.Fatalf("login failed with status %d", code)
+	}
+	rehashed := storedPasshash(t, db)
+	if !strings.HasPrefix(rehashed, "$2") || app.Hasher.NeedsRehash(rehashed) {
+		t.Fatalf("password not rehashed with the configured hasher: %s", rehashed)
+	}
+	if code := postLogin(t, app, "alice", "secret"); code != http.StatusOK {
+		t.Errorf("login with the rehashed password failed with status %d", code)
+	}
+}
+
+// storedPasshash returns the password hash stored for alice.
+func storedPasshash(t *testing.T, db *Database) string {
+	t.Helper()
+	obj, err := db.GetObj("users", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passhash, _ := obj.(map[string]interface{})["passhash"].(string)
+	return passhash
+}
@@ -0,0 +1,377 @@
+//    Title: policy.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// After a wrong room password, a client must wait passwordBackoff
+// before trying again, twice as long after every further failure up to
+// maxPasswordBackoff. A password policy verifies at most passwordChecks
+// passwords at once; attempts beyond that are refused.
+const (
+	passwordBackoff    = time.Second
+	maxPasswordBackoff = time.Minute
+	passwordChecks     = 4
+)
+
+// JoinPolicy decides whether a connection may join the room named room;
+// password is the one sent with the join message, if any.
+// It returns nil to let the connection in, or the error sent back to it
+// in a joinDenied event.
+type JoinPolicy func(c *Conn, room string, password string) error
+
+// JoinRequest is the payload of a join message.
+// If Since is set, the messages of the room's history whose sequence
+// number is above it are sent before any later message.
+type JoinRequest struct {
+	Password string  `json:"password,omitempty"`
+	Since    *uint64 `json:"since,omitempty"`
+}
+
+// joinPolicy is a policy registered with App.SetJoinPolicy.
+type joinPolicy struct {
+	pattern string
+	policy  JoinPolicy
+}
+
+// AllowAll returns the policy of public rooms, which anyone may join.
+func AllowAll() JoinPolicy {
+	return func(c *Conn, room string, password string) error {
+		return nil
+	}
+}
+
+// AllowInvited returns a policy letting in the users in invites only.
+// Connections without a session are never invited.
+func AllowInvited(invites *Invites) JoinPolicy {
+	return func(c *Conn, room string, password string) error {
+		if c.username == "" || !invites.Has(c.username) {
+			return ErrJoinDenied
+		}
+		return nil
+	}
+}
+
+// AllowPassword returns a policy letting in connections sending the password
+// matching encoded, a hash produced by any registered hasher.
+// Clients trying again too soon after a wrong password, even from another
+// connection, or while other passwords are being verified, are refused with
+// ErrTooManyAttempts.
+func AllowPassword(encoded string) JoinPolicy {
+	checks := make(chan struct{}, passwordChecks)
+	return func(c *Conn, room string, password string) error {
+		if password == "" {
+			return ErrJoinDenied
+		}
+		if !c.app.throttle.allowed(c.client()) {
+			return ErrTooManyAttempts
+		}
+		select {
+		case checks <- struct{}{}:
+		default:
+			return ErrTooManyAttempts
+		}
+		ok, err := VerifyPassword(password, encoded)
+		<-checks
+		c.app.throttle.record(c.client(), err == nil && ok)
+		if err != nil || !ok {
+			return ErrJoinDenied
+		}
+		return nil
+	}
+}
+
+// passwordThrottle keeps the wrong room passwords sent by every client,
+// keyed by the client's address, so that reconnecting does not end its
+// backoff. Clients behind the same proxy share their backoff.
+type passwordThrottle struct {
+	mu      sync.Mutex
+	clients map[string]*passwordFailures
+}
+
+// passwordFailures counts the wrong passwords sent by a client and when
+// it may try again.
+type passwordFailures struct {
+	count int
+	retry time.Time
+}
+
+// allowed reports whether the backoff of client is over.
+func (t *passwordThrottle) allowed(client string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.clients[client]
+	return !ok || !time.Now().Before(f.retry)
+}
+
+// record records whether a room password sent by client was right,
+// forgetting its failures or doubling its backoff. Clients whose backoff
+// ended long enough ago are forgotten as well.
+func (t *passwordThrottle) record(client string, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ok {
+		delete(t.clients, client)
+		return
+	}
+	now := time.Now()
+	for key, f := range t.clients {
+		if now.Sub(f.retry) > maxPasswordBackoff {
+			delete(t.clients, key)
+		}
+	}
+	if t.clients == nil {
+		t.clients = make(map[string]*passwordFailures)
+	}
+	f, found := t.clients[client]
+	if !found {
+		f = &passwordFailures{}
+		t.clients[client] = f
+	}
+	backoff := maxPasswordBackoff
+	if f.count < 6 {
+		backoff = passwordBackoff << uint(f.count)
+	}
+	if backoff > maxPasswordBackoff {
+		backoff = maxPasswordBackoff
+	}
+	f.count++
+	f.retry = now.Add(backoff)
+}
+
+// client returns the key of the connection's client in a passwordThrottle:
+// its remote host, or its id if the host is unknown.
+func (c *Conn) client() string {
+	if c.addr != "" {
+		return c.addr
+	}
+	return c.id
+}
+
+// AllowRoles returns a policy letting in connections having one of roles.
+// Connections without a session have the guest role.
+func AllowRoles(roles ...string) JoinPolicy {
+	return func(c *Conn, room string, password string) error {
+		role := c.privilege
+		if role == "" {
+			role = "guest"
+		}
+		for _, r := range roles {
+			if r == role {
+				return nil
+			}
+		}
+		return ErrJoinDenied
+	}
+}
+
+// AllowIf returns a policy letting in the connections for which fn returns true.
+func AllowIf(fn func(c *Conn, room string) bool) JoinPolicy {
+	return func(c *Conn, room string, password string) error {
+		if !fn(c, room) {
+			return ErrJoinDenied
+		}
+		return nil
+	}
+}
+
+// Invites is a set of user names invited to a room. It is safe for concurrent use.
+type Invites struct {
+	mu    sync.RWMutex
+	users map[string]bool
+}
+
+// NewInvites creates a set of invites holding usernames.
+// It returns the new invites.
+func NewInvites(usernames ...string) *Invites {
+	i := &Invites{users: make(map[string]bool)}
+	for _, username := range usernames {
+		i.users[username] = true
+	}
+	return i
+}
+
+// Add invites username.
+func (i *Invites) Add(username string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.users[username] = true
+}
+
+// Remove withdraws the invitation of username.
+// Connections that already joined stay in the room.
+func (i *Invites) Remove(username string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.users, username)
+}
+
+// Has reports whether username is invited.
+func (i *Invites) Has(username string) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.users[username]
+}
+
+// SetJoinPolicy sets the policy of the rooms whose names match pattern,
+// a colon separated pattern like the permissions of roles, e.g. "dm:*".
+// Policies set this way take precedence over the rooms block of config.json;
+// the first pattern set matching a room applies, and setting a pattern again
+// replaces its policy.
+func (a *App) SetJoinPolicy(pattern string, policy JoinPolicy) {
+	a.joinMu.Lock()
+	defer a.joinMu.Unlock()
+	for i, p := range a.joinPolicies {
+		if p.pattern == pattern {
+			a.joinPolicies[i].policy = policy
+			return
+		}
+	}
+	a.joinPolicies = append(a.joinPolicies, joinPolicy{pattern: pattern, policy: policy})
+}
+
+// JoinPolicy returns the policy of the room named name: the first policy
+// set with SetJoinPolicy whose pattern matches name, or else the policy of
+// the entry named after the room in the rooms block of config.json, or of
+// its default entry. Rooms without a policy are public.
+func (a *App) JoinPolicy(name string) JoinPolicy {
+	a.joinMu.RLock()
+	for _, p := range a.joinPolicies {
+		if matchPermission(p.pattern, name) {
+			a.joinMu.RUnlock()
+			return p.policy
+		}
+	}
+	a.joinMu.RUnlock()
+	entry := name
+	if _, ok := a.Rooms[name]["policy"]; !ok {
+		entry = "default"
+	}
+	return a.roomPolicy(entry)
+}
+
+// roomPolicy returns the policy of an entry of the rooms block of
+// config.json. Policies are created once, when the config is checked or
+// else on first use, so that the state they keep is shared by every join.
+func (a *App) roomPolicy(entry string) JoinPolicy {
+	a.joinMu.RLock()
+	policy, ok := a.roomPolicies[entry]
+	a.joinMu.RUnlock()
+	if ok {
+		return policy
+	}
+	a.joinMu.Lock()
+	defer a.joinMu.Unlock()
+	if policy, ok := a.roomPolicies[entry]; ok {
+		return policy
+	}
+	policy, err := configPolicy(a.Rooms[entry])
+	if err != nil {
+		policy = func(c *Conn, room string, password string) error {
+			return err
+		}
+	}
+	if a.roomPolicies == nil {
+		a.roomPolicies = make(map[string]JoinPolicy)
+	}
+	a.roomPolicies[entry] = policy
+	return policy
+}
+
+// CanJoin checks whether a connection may join the room named name with
+// password. Every connection may join the root room.
+// It returns nil or the error denying the join.
+func (a *App) CanJoin(c *Conn, name string, password string) error {
+	if name == "root" {
+		return nil
+	}
+	return a.JoinPolicy(name)(c, name, password)
+}
+
+// configPolicy creates the policy described by an entry of the rooms block:
+// policy is public, invite with the comma separated user names in invite,
+// password with the hash in password, or role with the comma separated
+// roles in roles.
+// It returns the policy or an error.
+func configPolicy(params map[string]string) (JoinPolicy, error) {
+	switch params["policy"] {
+	case "", "public":
+		return AllowAll(), nil
+	case "invite":
+		return AllowInvited(NewInvites(splitList(params["invite"])...)), nil
+	case "password":
+		if params["password"] == "" {
+			return nil, fmt.Errorf("password policy without a password")
+		}
+		return AllowPassword(params["password"]), nil
+	case "role":
+		roles := splitList(params["roles"])
+		if len(roles) == 0 {
+			return nil, fmt.Errorf("role policy without roles")
+		}
+		return AllowRoles(roles...), nil
+	}
+	return nil, fmt.Errorf("unknown policy %q", params["policy"])
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// HandleJoin handles a join message, whose payload is a JoinRequest or null.
+// Connections refused by the room's policy are sent a joinDenied event.
+// It returns an error if any occur.
+func (c *Conn) HandleJoin(data *Message) error {
+	req := &JoinRequest{}
+	if err := data.Decode(req); err != nil {
+		return err
+	}
+	if _, ok := c.room(data.Room); !ok {
+		if err := c.app.CanJoin(c, data.Room, req.Password); err != nil {
+			c.SendJoinDenied(data, err)
+			return nil
+		}
+	}
+	c.join(data.Room, req.Since)
+	return nil
+}
+
+// SendJoinDenied tells the connection that it may not join the room named
+// in data. The joinDenied event carries the error converted with AsError.
+func (c *Conn) SendJoinDenied(data *Message, err error) {
+	e := AsError(err)
+	e.Event = data.Event
+	e.ID = data.ID
+	c.Send(&Message{
+		Room:    data.Room,
+		Event:   "joinDenied",
+		ID:      data.ID,
+		Payload: rawPayload(e),
+	})
+}
@@ -0,0 +1,134 @@
+//    Title: policy_test.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"testing"
+	"time"
+)
+
+func TestAllowPasswordBackoff(t *testing.T) {
+	hash, err := (&BcryptHasher{Cost: 4}).Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := AllowPassword(hash)
+	app := &App{}
+	c := &Conn{app: app, addr: "192.0.2.1"}
+	if err := policy(c, "vault", "wrong"); err != ErrJoinDenied {
+		t.Fatalf("wrong password: got %v", err)
+	}
+	if err := policy(c, "vault", "secret"); err != ErrTooManyAttempts {
+		t.Fatalf("retry during backoff: got %v", err)
+	}
+	if err := policy(&Conn{app: app, addr: "192.0.2.1"}, "vault", "secret"); err != ErrTooManyAttempts {
+		t.Fatalf("retry from a new connection during backoff: got %v", err)
+	}
+	if err := policy(&Conn{app: app, addr: "192.0.2.2"}, "vault", "secret"); err != nil {
+		t.Fatalf("other client: got %v", err)
+	}
+	app.throttle.clients["192.0.2.1"].retry = time.Now()
+	if err := policy(c, "vault", "wrong"); err != ErrJoinDenied {
+		t.Fatalf("second wrong password: got %v", err)
+	}
+	if wait := time.Until(app.throttle.clients["192.0.2.1"].retry); wait <= passwordBackoff {
+		t.Errorf("backoff not doubled: %s", wait)
+	}
+}
+
+func TestConfigPasswordRoom(t *testing.T) {
+	hash, err := (&BcryptHasher{Cost: 4}).Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(t, fmt.Sprintf(`, "rooms": {"vault": {"policy": "password", "password": %q}}`, hash))
+	if len(app.roomPolicies) != 1 {
+		t.Fatalf("got %d room policies, want the vault policy", len(app.roomPolicies))
+	}
+	join := func(ws *websocket.Conn, password string) *Message {
+		payload, _ := json.Marshal(&JoinRequest{Password: password})
+		if err := ws.WriteJSON(&Message{Room: "vault", Event: "join", Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			msg := &Message{}
+			if err := ws.ReadJSON(msg); err != nil {
+				t.Fatalf("waiting for the vault join: %v", err)
+			}
+			if msg.Room == "vault" && (msg.Event == "join" || msg.Event == "joinDenied") {
+				return msg
+			}
+		}
+	}
+	denied := func(msg *Message) string {
+		if msg.Event != "joinDenied" {
+			return ""
+		}
+		var e Error
+		if err := json.Unmarshal(msg.Payload, &e); err != nil {
+			t.Fatal(err)
+		}
+		return e.Code
+	}
+	first := dialTestApp(t, app)
+	readUntil(t, first, "join")
+	if code := denied(join(first, "wrong")); code != ErrJoinDenied.Code {
+		t.Fatalf("wrong password: got %q", code)
+	}
+	second := dialTestApp(t, app)
+	readUntil(t, second, "join")
+	if code := denied(join(second, "secret")); code != ErrTooManyAttempts.Code {
+		t.Fatalf("retry from another connection during backoff: got %q", code)
+	}
+	app.throttle.mu.Lock()
+	for _, f := range app.throttle.clients {
+		f.retry = time.Now()
+	}
+	app.throttle.mu.Unlock()
+	if code := denied(join(second, "secret")); code != "" {
+		t.Fatalf("right password after backoff: got %q", code)
+	}
+}
+
+func TestLivePermission(t *testing.T) {
+	payload, _ := json.Marshal(&Change{DB: "memory", Table: "test", Key: "a"})
+	if p := livePermission(&Message{Event: "objUpdated", Payload: payload}); p != "getObj:memory:test" {
+		t.Errorf("got %q", p)
+	}
+	if p := livePermission(&Message{Event: "chat", Payload: payload}); p != "" {
+		t.Errorf("got %q for an application event", p)
+	}
+}
+
+func TestRoomChangesNeedGetObj(t *testing.T) {
+	app := newTestApp(t, `, "roles": {"guest": ["subscribe:*", "getObj:memory:test"], "user": []}`)
+	allowed := &Conn{app: app, privilege: "guest", out: newOutbox(16, Disconnect)}
+	denied := &Conn{app: app, privilege: "user", out: newOutbox(16, Disconnect)}
+	room := &Room{app: app, name: "feed", members: map[*Conn]*Member{allowed: {}, denied: {}}}
+	payload, _ := json.Marshal(&Change{DB: "memory", Table: "test", Key: "a"})
+	room.broadcast(&Message{Room: "feed", Event: "objInserted", Payload: payload})
+	if allowed.out.pop() == nil {
+		t.Error("change not sent to a member allowed to get it")
+	}
+	if denied.out.pop() != nil {
+		t.Error("change sent to a member not allowed to get it")
+	}
+}
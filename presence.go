@@ -0,0 +1,156 @@
+//    Title: presence.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+)
+
+// Member describes a connection in a room: its id, the user it was opened
+// for, that user's role, and the state the connection last set with a
+// setState message.
+type Member struct {
+	ID        string          `json:"id"`
+	Username  string          `json:"username,omitempty"`
+	Privilege string          `json:"privilege,omitempty"`
+	State     json.RawMessage `json:"state,omitempty"`
+}
+
+// Presence is the payload of a presence event, sent to every member of a
+// room when a member joins, leaves, or changes its state.
+// Action is "join", "leave" or "state".
+type Presence struct {
+	Action string `json:"action"`
+	Member Member `json:"member"`
+}
+
+// memberState is a state change requested by a member.
+type memberState struct {
+	conn  *Conn
+	state json.RawMessage
+}
+
+// Members returns a snapshot of the members of the room on every instance,
+// sorted by id.
+func (r *Room) Members() []Member {
+	r.mu.RLock()
+	members := make([]Member, 0, len(r.members))
+	for _, m := range r.members {
+		members = append(members, *m)
+	}
+	for _, n := range r.remote {
+		for _, m := range n.members {
+			members = append(members, m)
+		}
+	}
+	r.mu.RUnlock()
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+// localMembers returns a snapshot of the members of the room on this instance.
+// It must be called from the room's goroutine.
+func (r *Room) localMembers() []Member {
+	members := make([]Member, 0, len(r.members))
+	for _, m := range r.members {
+		members = append(members, *m)
+	}
+	return members
+}
+
+// SetState sets the state of a member of the room, which is sent to every
+// member in a presence event. A null or empty state clears it.
+// It returns false if the room has been destroyed.
+func (r *Room) SetState(c *Conn, state json.RawMessage) bool {
+	if string(state) == "null" {
+		state = nil
+	}
+	select {
+	case r.state <- memberState{conn: c, state: state}:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// sendMembers sends the members of the room to c in a members event.
+// It must be called from the room's goroutine, so that c receives the
+// list before any presence event about a later change.
+func (r *Room) sendMembers(c *Conn) {
+	msg, err := NewMessage(r.name, "members", r.Members())
+	if err != nil {
+		log.Println("error encoding members: ", err)
+		return
+	}
+	c.Send(msg)
+}
+
+// announce publishes a change to a local member m to every instance.
+// It must be called from the room's goroutine.
+func (r *Room) announce(action string, m *Member) {
+	if m == nil {
+		return
+	}
+	r.publish(&envelope{Kind: "presence", Action: action, Members: []Member{*m}})
+}
+
+// presence tells every local member of the room about a change to m.
+// It must be called from the room's goroutine.
+func (r *Room) presence(action string, m Member) {
+	if r.name == "root" {
+		return
+	}
+	msg, err := NewMessage(r.name, "presence", Presence{Action: action, Member: m})
+	if err != nil {
+		log.Println("error encoding presence: ", err)
+		return
+	}
+	r.broadcast(msg)
+}
+
+// HandlePresenceData handles a setState or listMembers message about the
+// room it names, which the connection must be a member of.
+// listMembers is answered with a members event carrying the message's id.
+// It returns an error if any occur.
+func (c *Conn) HandlePresenceData(data *Message) error {
+	room, ok := c.room(data.Room)
+	if !ok || data.Room == "root" {
+		return ErrNotMember
+	}
+	switch data.Event {
+	case "setState":
+		if len(data.Payload) > 0 && !json.Valid(data.Payload) {
+			return ErrBadPayload
+		}
+		room.SetState(c, data.Payload)
+		if data.ID != "" {
+			c.SendResult(data, nil)
+		}
+	case "listMembers":
+		msg, err := NewMessage(data.Room, "members", room.Members())
+		if err != nil {
+			return err
+		}
+		msg.ID = data.ID
+		c.Send(msg)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+//    Title: query.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// The fields a query may filter or sort on: dot separated JSON object keys.
+	fieldregex = regexp.MustCompile("^[A-Za-z0-9_]+(\\.[A-Za-z0-9_]+)*$")
+	// The filters accepted in the filter field of a route.
+	filterregex = regexp.MustCompile("^([A-Za-z0-9_.]+)(!=|<=|>=|=|<|>)(.*)$")
+	// The comparison operators a filter may use.
+	filterops = map[string]bool{"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+)
+
+// Filter is a predicate on a field of the JSON objects stored in a table.
+// Objects whose field is missing or holds a value of a different type
+// than Value never match.
+type Filter struct {
+	// Field is the dot separated path of the field, e.g. "author.name".
+	Field string
+	// Op is one of =, !=, <, <=, > or >=.
+	Op string
+	// Value is a string, float64 or bool.
+	Value interface{}
+}
+
+// Order sorts the objects of a table on a field.
+type Order struct {
+	Field string
+	Desc  bool
+}
+
+// Query selects, sorts and paginates the objects in a table.
+type Query struct {
+	Filters []Filter
+	Sort    []Order
+	Limit   int
+	Offset  int
+}
+
+// ParseQuery builds a query from the filter, sort, limit and offset fields of a route.
+// filter is a comma separated list of predicates such as "status=active,age>=18";
+// sort is a comma separated list of fields, each prefixed with "-" to sort descending.
+// It returns nil if the route has none of these fields, or an error.
+func ParseQuery(route map[string]string) (*Query, error) {
+	q := &Query{}
+	found := false
+	if filter, ok := route["filter"]; ok && filter != "" {
+		found = true
+		for _, pred := range strings.Split(filter, ",") {
+			match := filterregex.FindStringSubmatch(strings.TrimSpace(pred))
+			if match == nil {
+				return nil, fmt.Errorf("Invalid filter: %s", pred)
+			}
+			q.Filters = append(q.Filters, Filter{
+				Field: match[1],
+				Op:    match[2],
+				Value: parseValue(match[3]),
+			})
+		}
+	}
+	if order, ok := route["sort"]; ok && order != "" {
+		found = true
+		for _, field := range strings.Split(order, ",") {
+			field = strings.TrimSpace(field)
+			q.Sort = append(q.Sort, Order{
+				Field: strings.TrimPrefix(field, "-"),
+				Desc:  strings.HasPrefix(field, "-"),
+			})
+		}
+	}
+	for _, name := range []string{"limit", "offset"} {
+		val, ok := route[name]
+		if !ok || val == "" {
+			continue
+		}
+		found = true
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid %s: %s", name, val)
+		}
+		if name == "limit" {
+			q.Limit = n
+		} else {
+			q.Offset = n
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return q, q.Validate()
+}
+
+// parseValue converts the value of a filter into a bool, float64 or string.
+func parseValue(val string) interface{} {
+	if val == "true" || val == "false" {
+		return val == "true"
+	}
+	if n, err := strconv.ParseFloat(val, 64); err == nil {
+		return n
+	}
+	return strings.Trim(val, "\"'")
+}
+
+// Validate checks the fields and operators of a query, since stores
+// interpolate field names into their native query languages.
+// It may return an error.
+func (q *Query) Validate() error {
+	for _, f := range q.Filters {
+		if !fieldregex.MatchString(f.Field) {
+			return fmt.Errorf("Invalid field: %s", f.Field)
+		}
+		if !filterops[f.Op] {
+			return fmt.Errorf("Invalid operator: %s", f.Op)
+		}
+		switch f.Value.(type) {
+		case string, float64, bool:
+		default:
+			return errors.New("Filter values must be strings, numbers or booleans.")
+		}
+	}
+	for _, o := range q.Sort {
+		if !fieldregex.MatchString(o.Field) {
+			return fmt.Errorf("Invalid field: %s", o.Field)
+		}
+	}
+	if q.Limit < 0 || q.Offset < 0 {
+		return errors.New("Limit and offset must not be negative.")
+	}
+	return nil
+}
+
+// FilterObjs applies a query to objects as returned by Store.GetAllObjs.
+// Stores without a native query language use it to implement QueryObjs.
+// It returns the matching objects.
+func FilterObjs(objs []interface{}, q *Query) []interface{} {
+	data := make([]interface{}, 0)
+	for _, obj := range objs {
+		matched := true
+		for _, f := range q.Filters {
+			if !f.match(lookupField(obj, f.Field)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			data = append(data, obj)
+		}
+	}
+	if len(q.Sort) > 0 {
+		sort.SliceStable(data, func(i, j int) bool {
+			for _, o := range q.Sort {
+				c := compareValues(lookupField(data[i], o.Field), lookupField(data[j], o.Field))
+				if c == 0 {
+					continue
+				}
+				return (c < 0) != o.Desc
+			}
+			return false
+		})
+	}
+	if q.Offset >= len(data) {
+		return data[:0]
+	}
+	data = data[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(data) {
+		data = data[:q.Limit]
+	}
+	return data
+}
+
+// lookupField returns the value at the dot separated path within the data
+// field of obj, or nil.
+func lookupField(obj interface{}, path string) interface{} {
+	collect, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	value := collect["data"]
+	for _, name := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[name]
+	}
+	return value
+}
+
+// match reports whether value satisfies the filter.
+// As in the SQL stores, values of a different type never match.
+func (f Filter) match(value interface{}) bool {
+	if typeRank(value) != typeRank(f.Value) {
+		return false
+	}
+	c := compareValues(value, f.Value)
+	switch f.Op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// typeRank orders JSON values of different types: null, booleans,
+// numbers, strings, then arrays and objects.
+func typeRank(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	}
+	return 4
+}
+
+// compareValues compares two JSON values.
+// It returns -1, 0 or 1.
+func compareValues(a interface{}, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+	switch va := a.(type) {
+	case bool:
+		vb := b.(bool)
+		if va == vb {
+			return 0
+		} else if !va {
+			return -1
+		}
+		return 1
+	case float64:
+		vb := b.(float64)
+		if va < vb {
+			return -1
+		} else if va > vb {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(va, b.(string))
+	}
+	return 0
+}
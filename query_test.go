@@ -0,0 +1,157 @@
+//    Title: query_test.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		route map[string]string
+		want  *Query
+		err   bool
+	}{
+		{route: map[string]string{"table": "posts"}, want: nil},
+		{
+			route: map[string]string{"filter": "status=active, age>=18,draft!=true", "sort": "-date,title", "limit": "10", "offset": "20"},
+			want: &Query{
+				Filters: []Filter{
+					{Field: "status", Op: "=", Value: "active"},
+					{Field: "age", Op: ">=", Value: float64(18)},
+					{Field: "draft", Op: "!=", Value: true},
+				},
+				Sort:   []Order{{Field: "date", Desc: true}, {Field: "title"}},
+				Limit:  10,
+				Offset: 20,
+			},
+		},
+		{route: map[string]string{"filter": "author.name='jd'"}, want: &Query{Filters: []Filter{{Field: "author.name", Op: "=", Value: "jd"}}}},
+		{route: map[string]string{"filter": "id=\"42\""}, want: &Query{Filters: []Filter{{Field: "id", Op: "=", Value: "42"}}}},
+		{route: map[string]string{"limit": "5"}, want: &Query{Limit: 5}},
+		{route: map[string]string{"filter": "status"}, err: true},
+		{route: map[string]string{"filter": "a..b=1"}, err: true},
+		{route: map[string]string{"filter": "na-me=1"}, err: true},
+		{route: map[string]string{"sort": "name;drop"}, err: true},
+		{route: map[string]string{"sort": "-"}, err: true},
+		{route: map[string]string{"limit": "-1"}, err: true},
+		{route: map[string]string{"offset": "ten"}, err: true},
+	}
+	for _, test := range tests {
+		got, err := ParseQuery(test.route)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseQuery(%v) succeeded", test.route)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseQuery(%v): %v", test.route, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseQuery(%v) = %+v, want %+v", test.route, got, test.want)
+		}
+	}
+}
+
+func TestQueryValidate(t *testing.T) {
+	tests := []struct {
+		query *Query
+		ok    bool
+	}{
+		{&Query{Filters: []Filter{{Field: "a.b_c", Op: "<=", Value: "x"}}}, true},
+		{&Query{Filters: []Filter{{Field: "a", Op: "LIKE", Value: "x"}}}, false},
+		{&Query{Filters: []Filter{{Field: "a' OR 1=1 --", Op: "=", Value: "x"}}}, false},
+		{&Query{Filters: []Filter{{Field: "a", Op: "=", Value: []string{"x"}}}}, false},
+		{&Query{Sort: []Order{{Field: ""}}}, false},
+		{&Query{Offset: -1}, false},
+	}
+	for _, test := range tests {
+		if err := test.query.Validate(); (err == nil) != test.ok {
+			t.Errorf("Validate(%+v) = %v", test.query, err)
+		}
+	}
+}
+
+// testObj wraps data as the stores return objects.
+func testObj(hash string, data map[string]interface{}) interface{} {
+	return map[string]interface{}{"hash": hash, "data": data}
+}
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		filter Filter
+		value  interface{}
+		want   bool
+	}{
+		{Filter{Op: "=", Value: "a"}, "a", true},
+		{Filter{Op: "!=", Value: "a"}, "b", true},
+		{Filter{Op: "<", Value: float64(2)}, float64(1), true},
+		{Filter{Op: "<=", Value: float64(2)}, float64(2), true},
+		{Filter{Op: ">", Value: float64(2)}, float64(2), false},
+		{Filter{Op: ">=", Value: "b"}, "c", true},
+		{Filter{Op: "=", Value: true}, true, true},
+		{Filter{Op: ">", Value: false}, true, true},
+		{Filter{Op: "=", Value: float64(1)}, "1", false},
+		{Filter{Op: "!=", Value: float64(1)}, "1", false},
+		{Filter{Op: "!=", Value: "a"}, nil, false},
+		{Filter{Op: "<", Value: "a"}, float64(1), false},
+		{Filter{Op: "=", Value: "a"}, map[string]interface{}{}, false},
+	}
+	for _, test := range tests {
+		if got := test.filter.match(test.value); got != test.want {
+			t.Errorf("%v %s %v = %v, want %v", test.value, test.filter.Op, test.filter.Value, got, test.want)
+		}
+	}
+}
+
+func TestFilterObjs(t *testing.T) {
+	objs := []interface{}{
+		testObj("a", map[string]interface{}{"age": float64(30), "author": map[string]interface{}{"name": "jd"}}),
+		testObj("b", map[string]interface{}{"age": float64(20), "author": map[string]interface{}{"name": "al"}}),
+		testObj("c", map[string]interface{}{"age": "unknown"}),
+		testObj("d", map[string]interface{}{"age": float64(20), "author": map[string]interface{}{"name": "zo"}}),
+		"not an object",
+	}
+	tests := []struct {
+		query *Query
+		want  []string
+	}{
+		{&Query{}, []string{"a", "b", "c", "d", ""}},
+		{&Query{Filters: []Filter{{Field: "age", Op: ">=", Value: float64(20)}}}, []string{"a", "b", "d"}},
+		{&Query{Filters: []Filter{{Field: "author.name", Op: "!=", Value: "jd"}}}, []string{"b", "d"}},
+		{&Query{Sort: []Order{{Field: "age"}, {Field: "author.name", Desc: true}}}, []string{"", "d", "b", "a", "c"}},
+		{&Query{Sort: []Order{{Field: "age", Desc: true}}, Limit: 2}, []string{"c", "a"}},
+		{&Query{Sort: []Order{{Field: "author.name"}}, Offset: 3, Limit: 5}, []string{"a", "d"}},
+		{&Query{Offset: 10}, []string{}},
+	}
+	for _, test := range tests {
+		got := make([]string, 0)
+		for _, obj := range FilterObjs(objs, test.query) {
+			hash := ""
+			if m, ok := obj.(map[string]interface{}); ok {
+				hash = m["hash"].(string)
+			}
+			got = append(got, hash)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("FilterObjs(%+v) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+//    Title: resume.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultResumeGrace is how long a dropped connection is kept, with its id,
+// rooms and undelivered messages, waiting for the client to resume it.
+const DefaultResumeGrace = 30 * time.Second
+
+// ResumeGrace returns how long a dropped connection may be resumed for,
+// as set by the grace field of the resume block of config.json.
+// Zero disables resuming.
+func (a *App) ResumeGrace() time.Duration {
+	if val, ok := a.Resume["grace"]; ok {
+		if d, err := time.ParseDuration(val); err == nil && d >= 0 {
+			return d
+		}
+	}
+	return DefaultResumeGrace
+}
+
+// checkResume validates the resume block of config.json.
+// It returns an error if it is invalid.
+func (a *App) checkResume() error {
+	if val, ok := a.Resume["grace"]; ok {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("resume: %v", err)
+		}
+		if d < 0 {
+			return fmt.Errorf("resume: grace must not be negative, got %s", d)
+		}
+	}
+	return nil
+}
+
+// issueToken gives c a new resume token, replacing the one it had.
+// A connection left without a token cannot be resumed.
+func (h *Hub) issueToken(c *Conn) string {
+	token, err := randomToken()
+	if err != nil {
+		log.Println("error creating resume token: ", err)
+		token = ""
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" {
+		delete(h.tokens, c.token)
+	}
+	c.token = token
+	if token != "" {
+		h.tokens[token] = c
+	}
+	return token
+}
+
+// claim takes the parked connection holding token, provided it was opened
+// with session, stopping its grace period. Tokens are single use.
+// It returns false if there is no such connection.
+func (h *Hub) claim(token string, session *Session) (*Conn, bool) {
+	id := ""
+	if session != nil {
+		id = session.ID
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.tokens[token]
+	if !ok || c.session != id {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.parked == nil || !c.parked.Stop() {
+		return nil, false
+	}
+	c.parked = nil
+	delete(h.tokens, token)
+	c.token = ""
+	return c, true
+}
+
+// park keeps a connection whose socket dropped for the resume grace period,
+// after which it is closed. Messages sent to it meanwhile are queued as
+// usual, subject to its overflow policy. Its streams are aborted.
+// It returns false if the connection cannot be resumed.
+func (c *Conn) park() bool {
+	grace := c.app.ResumeGrace()
+	if grace <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	if c.closing || c.token == "" {
+		c.mu.Unlock()
+		return false
+	}
+	c.parked = time.AfterFunc(grace, c.Close)
+	c.mu.Unlock()
+	c.streams.abort(ErrStreamAborted)
+	return true
+}
+
+// resume attaches socket to a claimed connection, once the pump writing to
+// its previous socket has stopped, and sends the client a resume event
+// with a new token.
+// It returns false if the connection was closed meanwhile.
+func (c *Conn) resume(socket *websocket.Conn) bool {
+	c.mu.Lock()
+	written := c.written
+	c.mu.Unlock()
+	<-written
+	c.app.Hub.issueToken(c)
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		socket.Close()
+		return false
+	}
+	c.socket = socket
+	c.codec = codecFor(socket.Subprotocol())
+	c.quit = make(chan struct{})
+	c.written = make(chan struct{})
+	c.live = true
+	c.mu.Unlock()
+	if err := c.writeMessage(socket, c.resumeMessage(true)); err != nil {
+		log.Println("error resuming connection: ", err)
+	}
+	return true
+}
+
+// resumeMessage creates the resume event telling the client its connection
+// id, the token to resume it with and whether it was resumed.
+// It returns the event.
+func (c *Conn) resumeMessage(resumed bool) *Message {
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+	return &Message{
+		Room:  "root",
+		Event: "resume",
+		Payload: rawPayload(map[string]interface{}{
+			"id":      c.id,
+			"token":   token,
+			"resumed": resumed,
+		}),
+	}
+}
+
+// Close closes the connection for good: it leaves its rooms and is removed
+// from the hub. Closing a connection whose socket is open closes the socket,
+// and the connection once its pumps have stopped.
+// It is safe to call more than once and from any goroutine.
+func (c *Conn) Close() {
+	c.mu.Lock()
+	c.closing = true
+	if c.live {
+		socket := c.socket
+		c.mu.Unlock()
+		socket.Close()
+		return
+	}
+	if c.parked != nil {
+		c.parked.Stop()
+		c.parked = nil
+	}
+	c.mu.Unlock()
+	c.closeOnce.Do(func() {
+		c.roomsMu.Lock()
+		rooms := c.rooms
+		c.rooms = make(map[string]*Room)
+		c.roomsMu.Unlock()
+		for _, room := range rooms {
+			room.Leave(c)
+		}
+		c.app.Subscriptions.RemoveConn(c)
+		c.app.Hub.RemoveConn(c)
+		c.streams.abort(ErrStreamAborted)
+		c.out.close()
+		c.cancel()
+	})
+}
@@ -0,0 +1,91 @@
+//    Title: roles.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"path"
+	"strings"
+)
+
+// The roles used when config.json does not define any: admins may do
+// anything, while users and visitors without a session may only
+// send application events, make remote procedure calls and send streams.
+var defaultRoles = map[string][]string{
+	"admin": {"*"},
+	"user":  {"event:*", "rpc:*", "stream:*"},
+	"guest": {"event:*", "rpc:*", "stream:*"},
+}
+
+// Permissions are colon separated strings naming an operation and what it
+// applies to:
+//   - getObj, insertObj, updateObj, upsertObj, deleteObj, subscribe and
+//     unsubscribe are followed by the database and table, e.g. "getObj:postgres:users"
+//   - application events dispatched through App.Emitter are "event:<name>"
+//   - calls to handlers registered with App.HandleRPC are "rpc:<name>"
+//   - streams for handlers registered with App.HandleStream are "stream:<event>"
+//   - listSessions and killSession stand alone
+// Patterns granted to a role may use path.Match wildcards within a segment,
+// and a final "*" segment matches any remaining segments, so "*" grants
+// everything and "getObj:*" grants reads on every database.
+
+// matchPermission reports whether permission is granted by pattern.
+func matchPermission(pattern string, permission string) bool {
+	pats := strings.Split(pattern, ":")
+	perms := strings.Split(permission, ":")
+	for i, pat := range pats {
+		if i == len(pats)-1 && pat == "*" {
+			return true
+		}
+		if i >= len(perms) {
+			return false
+		}
+		if ok, err := path.Match(pat, perms[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return len(pats) == len(perms)
+}
+
+// Authorize reports whether role has been granted permission.
+// Roles come from the roles block of config.json; connections
+// without a session have the guest role.
+func (a *App) Authorize(role string, permission string) bool {
+	roles := a.Roles
+	if roles == nil {
+		roles = defaultRoles
+	}
+	if role == "" {
+		role = "guest"
+	}
+	for _, pattern := range roles[role] {
+		if matchPermission(pattern, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether the connection's role has been granted permission.
+func (c *Conn) Can(permission string) bool {
+	return c.app.Authorize(c.privilege, permission)
+}
+
+// Deny tells the connection that a message was refused.
+// The connection receives an ErrPermissionDenied error event.
+func (c *Conn) Deny(data *Message) {
+	c.SendError(data, ErrPermissionDenied)
+}
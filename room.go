@@ -17,88 +17,453 @@
 package rtgo
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// DefaultRoomGrace is how long an empty room is kept running for
+// rooms whose entry in config.json sets no grace.
+var DefaultRoomGrace = 30 * time.Second
+
 type Room struct {
-	app     *App
-	name    string
-	members map[*Conn]bool
-	stop    chan bool
-	join    chan *Conn
-	leave   chan *Conn
-	send    chan []byte
+	app          *App
+	name         string
+	mu           sync.RWMutex
+	members      map[*Conn]*Member
+	remote       map[string]*remoteNode
+	history      *history
+	historyDB    Store
+	historyTable string
+	historyDirty bool
+	sub          Subscription
+	inboxMu      sync.Mutex
+	inbox        []delivery
+	wake         chan struct{}
+	stop         chan bool
+	join         chan joinRequest
+	leave        chan *Conn
+	state        chan memberState
+	send         chan *Message
+	done         chan struct{}
+}
+
+// joinRequest is a connection joining a room, replaying the messages of
+// its history above since if it is not nil.
+type joinRequest struct {
+	conn  *Conn
+	since *uint64
+}
+
+// delivery is a message received from the broker.
+type delivery struct {
+	seq  uint64
+	data []byte
+}
+
+// Name returns the name of the room.
+func (r *Room) Name() string {
+	return r.name
 }
 
 // Start activates the room.
+// What is emitted in the room and changes to its members are published
+// through the app's broker, and sent to the room's members as the broker
+// delivers them, so that a room spans every instance sharing the broker.
+// Members are told about each other with presence events, and a joining
+// connection is sent the current members, except in the root room which
+// every connection joins.
+// Rooms with a history keep the last messages emitted in them, and replay
+// those a joining connection missed.
+// A room that stays without members on this instance for its grace period
+// is destroyed: it is removed from the hub and a later join starts a new
+// room with the same name.
 func (r *Room) Start() {
+	r.app.hooks.runRoom(&r.app.hooks.roomCreate, r)
+	r.openHistory()
+	sub, err := r.app.Broker.Subscribe(r.name, r.deliver)
+	if err != nil {
+		log.Println("error subscribing to room", r.name+":", err)
+	}
+	r.sub = sub
+	r.publish(&envelope{Kind: "sync"})
+	heartbeat := time.NewTicker(r.app.Heartbeat())
+	defer heartbeat.Stop()
+	grace := r.app.RoomGrace(r.name)
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	expire := timer.C
 	for {
 		select {
-		case c := <-r.join:
-			payload := &Message{
-				Room:    r.name,
-				Event:   "join",
-				Payload: c.id,
+		case req := <-r.join:
+			if expire != nil {
+				timer.Stop()
+				expire = nil
 			}
-			data, err := json.Marshal(payload)
-			if err != nil {
-				log.Println(err)
-				break
+			r.enter(req.conn)
+			if req.since != nil {
+				for _, m := range r.History(*req.since) {
+					if permission := livePermission(m); permission == "" || req.conn.Can(permission) {
+						req.conn.Send(m)
+					}
+				}
 			}
-			c.send <- data
-			r.members[c] = true
 		case c := <-r.leave:
 			if _, ok := r.members[c]; ok {
-				payload := &Message{
+				c.Send(&Message{
 					Room:    r.name,
-					Event:   "join",
-					Payload: c.id,
-				}
-				data, err := json.Marshal(payload)
-				if err != nil {
-					log.Println(err)
-					break
-				}
-				c.send <- data
-				delete(r.members, c)
+					Event:   "leave",
+					Payload: rawPayload(c.id),
+				})
+				r.remove(c)
+			}
+		case s := <-r.state:
+			if m, ok := r.members[s.conn]; ok {
+				r.mu.Lock()
+				m.State = s.state
+				r.mu.Unlock()
+				r.announce("state", m)
 			}
 		case data := <-r.send:
-			for c := range r.members {
-				select {
-				case c.send <- data:
-				default:
-					close(c.send)
-					delete(r.members, c)
-				}
+			r.publish(&envelope{Kind: "emit", Message: data})
+		case <-r.wake:
+			r.inboxMu.Lock()
+			inbox := r.inbox
+			r.inbox = nil
+			r.inboxMu.Unlock()
+			for _, d := range inbox {
+				r.receive(d)
 			}
+		case <-heartbeat.C:
+			r.heartbeat()
+		case <-expire:
+			r.destroy()
+			return
 		case <-r.stop:
+			r.destroy()
 			return
 		}
+		if len(r.members) == 0 && expire == nil {
+			r.app.hooks.runRoom(&r.app.hooks.roomEmpty, r)
+			timer.Reset(grace)
+			expire = timer.C
+		}
+	}
+}
+
+// enter adds a connection to the room's members, unless it already is one.
+func (r *Room) enter(c *Conn) {
+	c.Send(&Message{
+		Room:    r.name,
+		Event:   "join",
+		Payload: rawPayload(c.id),
+	})
+	if _, ok := r.members[c]; ok {
+		return
+	}
+	m := &Member{
+		ID:        c.id,
+		Username:  c.username,
+		Privilege: c.privilege,
+	}
+	r.mu.Lock()
+	r.members[c] = m
+	r.mu.Unlock()
+	r.announce("join", m)
+	if r.name != "root" {
+		r.sendMembers(c)
+	}
+	r.app.hooks.runConn(&r.app.hooks.join, r, c)
+}
+
+// deliver queues a message received from the broker for the room's
+// goroutine. It never blocks.
+func (r *Room) deliver(seq uint64, data []byte) {
+	r.inboxMu.Lock()
+	r.inbox = append(r.inbox, delivery{seq: seq, data: data})
+	r.inboxMu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// publish sends an envelope to every instance through the broker.
+// If the broker fails, the envelope is only handled by this instance.
+// The root room publishes what is emitted in it only.
+func (r *Room) publish(env *envelope) {
+	if r.name == "root" && env.Kind != "emit" {
+		return
+	}
+	env.Node = r.app.node
+	data, err := json.Marshal(env)
+	if err != nil {
+		log.Println("error encoding envelope: ", err)
+		return
+	}
+	if err := r.app.Broker.Publish(r.name, data); err != nil {
+		log.Println("error publishing to room", r.name+":", err)
+		r.receive(delivery{data: data})
+	}
+}
+
+// receive handles a message delivered by the broker.
+func (r *Room) receive(d delivery) {
+	env := &envelope{}
+	if err := json.Unmarshal(d.data, env); err != nil {
+		log.Println("error decoding envelope: ", err)
+		return
+	}
+	local := env.Node == r.app.node
+	switch env.Kind {
+	case "emit":
+		if env.Message != nil {
+			env.Message.Seq = d.seq
+			r.record(env.Message)
+			r.broadcast(env.Message)
+		}
+	case "presence":
+		if len(env.Members) != 1 {
+			return
+		}
+		m := env.Members[0]
+		if !local {
+			r.mu.Lock()
+			node := r.remoteNode(env.Node)
+			if env.Action == "leave" {
+				delete(node.members, m.ID)
+			} else {
+				node.members[m.ID] = m
+			}
+			r.mu.Unlock()
+		}
+		r.presence(env.Action, m)
+	case "sync":
+		if !local && len(r.members) > 0 {
+			r.publish(&envelope{Kind: "members", Members: r.localMembers()})
+		}
+	case "members":
+		if !local {
+			r.syncNode(env.Node, env.Members)
+		}
+	}
+}
+
+// remoteNode returns the members of the room on the instance named node,
+// marking it as just heard of. It must be called with r.mu held.
+func (r *Room) remoteNode(node string) *remoteNode {
+	n, ok := r.remote[node]
+	if !ok {
+		n = &remoteNode{members: make(map[string]Member)}
+		r.remote[node] = n
+	}
+	n.seen = time.Now()
+	return n
+}
+
+// syncNode replaces the members of the room on the instance named node,
+// telling the local members about the differences.
+func (r *Room) syncNode(node string, members []Member) {
+	r.mu.Lock()
+	n := r.remoteNode(node)
+	old := n.members
+	n.members = make(map[string]Member, len(members))
+	for _, m := range members {
+		n.members[m.ID] = m
+	}
+	if len(members) == 0 {
+		delete(r.remote, node)
+	}
+	r.mu.Unlock()
+	for id, m := range old {
+		if _, ok := n.members[id]; !ok {
+			r.presence("leave", m)
+		}
+	}
+	for _, m := range members {
+		prev, ok := old[m.ID]
+		if !ok {
+			r.presence("join", m)
+		} else if !bytes.Equal(prev.State, m.State) {
+			r.presence("state", m)
+		}
+	}
+}
+
+// heartbeat trims the history table, announces the room's local members to
+// the other instances and drops the members of instances not heard of for
+// three heartbeats.
+func (r *Room) heartbeat() {
+	r.trimHistory()
+	if r.name == "root" {
+		return
+	}
+	if len(r.members) > 0 {
+		r.publish(&envelope{Kind: "members", Members: r.localMembers()})
+	}
+	deadline := time.Now().Add(-3 * r.app.Heartbeat())
+	for node, n := range r.remote {
+		if n.seen.Before(deadline) {
+			r.syncNode(node, nil)
+		}
 	}
 }
 
-// Stop deactivates the room.
+// broadcast sends a message to every local member of the room.
+// Members whose send buffer is full are handled by their overflow policy,
+// and live changes only go to the members allowed to get them.
+func (r *Room) broadcast(data *Message) {
+	permission := livePermission(data)
+	for c := range r.members {
+		if permission == "" || c.Can(permission) {
+			c.push(data)
+		}
+	}
+}
+
+// remove deletes a member from the room and tells the others.
+func (r *Room) remove(c *Conn) {
+	m := r.members[c]
+	r.mu.Lock()
+	delete(r.members, c)
+	r.mu.Unlock()
+	r.announce("leave", m)
+	r.app.hooks.runConn(&r.app.hooks.leave, r, c)
+}
+
+// destroy removes the room from the hub, so that it is no longer found,
+// before releasing callers blocked on it. Other instances are told that
+// the members it still had are gone.
+func (r *Room) destroy() {
+	r.app.Hub.closeRoom(r)
+	r.mu.Lock()
+	members := r.members
+	r.members = make(map[*Conn]*Member)
+	r.mu.Unlock()
+	if len(members) > 0 {
+		r.publish(&envelope{Kind: "members"})
+	}
+	if r.sub != nil {
+		if err := r.sub.Unsubscribe(); err != nil {
+			log.Println("error unsubscribing from room", r.name+":", err)
+		}
+	}
+	close(r.done)
+	for c := range members {
+		r.app.hooks.runConn(&r.app.hooks.leave, r, c)
+	}
+	r.app.Subscriptions.RemoveRoom(r.name)
+	r.app.hooks.runRoom(&r.app.hooks.roomDestroy, r)
+}
+
+// Stop deactivates the room and removes it from the hub.
+// It returns once the room is destroyed.
 func (r *Room) Stop() {
-	r.stop <- true
+	select {
+	case r.stop <- true:
+		<-r.done
+	case <-r.done:
+	}
 }
 
 // Join will add a connection to the room.
-func (r *Room) Join(c *Conn) {
-	r.join <- c
+// It returns false if the room has been destroyed.
+func (r *Room) Join(c *Conn) bool {
+	return r.joinSince(c, nil)
+}
+
+// JoinSince will add a connection to the room, sending it the messages of
+// the room's history whose sequence number is above since before any
+// message emitted later.
+// It returns false if the room has been destroyed.
+func (r *Room) JoinSince(c *Conn, since uint64) bool {
+	return r.joinSince(c, &since)
+}
+
+// joinSince adds a connection to the room, replaying its history above
+// since if since is not nil.
+// It returns false if the room has been destroyed.
+func (r *Room) joinSince(c *Conn, since *uint64) bool {
+	select {
+	case r.join <- joinRequest{conn: c, since: since}:
+		return true
+	case <-r.done:
+		return false
+	}
 }
 
 // Leave will remove a connection from a room.
 func (r *Room) Leave(c *Conn) {
-	r.leave <- c
+	select {
+	case r.leave <- c:
+	case <-r.done:
+	}
 }
 
 // Emit will send a message to all connections in the room.
 func (r *Room) Emit(payload *Message) {
-	data, err := json.Marshal(payload)
-	if err != nil {
-		log.Println(err)
-		return
+	select {
+	case r.send <- payload:
+	case <-r.done:
+	}
+}
+
+// RoomGrace returns how long the room named name is kept running once empty.
+// The default entry of the rooms block in config.json is overridden
+// by the entry named after the room.
+func (a *App) RoomGrace(name string) time.Duration {
+	grace := DefaultRoomGrace
+	for _, entry := range []string{"default", name} {
+		val, ok := a.Rooms[entry]["grace"]
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			log.Println("ignoring rooms", entry+": invalid grace", val)
+			continue
+		}
+		grace = d
+	}
+	return grace
+}
+
+// checkRooms validates the rooms block of config.json.
+// It returns an error if any entry is invalid.
+func (a *App) checkRooms() error {
+	policies := make(map[string]JoinPolicy)
+	for name, params := range a.Rooms {
+		policy, err := configPolicy(params)
+		if err != nil {
+			return fmt.Errorf("rooms %s: %v", name, err)
+		}
+		policies[name] = policy
+		if val, ok := params["history"]; ok {
+			if size, err := strconv.Atoi(val); err != nil || size < 0 {
+				return fmt.Errorf("rooms %s: history must be a number of messages, got %q", name, val)
+			}
+		}
+		if dbname, ok := params["historydb"]; ok && dbname != "" {
+			if _, exists := a.Database[dbname]; !exists {
+				return fmt.Errorf("rooms %s: the history database does not exist: %s", name, dbname)
+			}
+		}
+		if val, ok := params["grace"]; ok {
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("rooms %s: %v", name, err)
+			}
+			if d <= 0 {
+				return fmt.Errorf("rooms %s: grace must be positive, got %s", name, d)
+			}
+		}
 	}
-	r.send <- data
+	a.joinMu.Lock()
+	a.roomPolicies = policies
+	a.joinMu.Unlock()
+	return nil
 }
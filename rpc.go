@@ -0,0 +1,80 @@
+//    Title: rpc.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+)
+
+// RPCHandler handles a remote procedure call made by a connection.
+// ctx is cancelled when the connection closes; payload may be decoded with DecodePayload.
+// The returned value is JSON encoded and sent back to the caller in a
+// result event; a returned error is sent back in an error event, keeping
+// the code of an *Error.
+type RPCHandler func(ctx context.Context, c *Conn, payload json.RawMessage) (interface{}, error)
+
+// HandleRPC registers handler for calls to name.
+// Calls are made by sending a message with the event name and an id,
+// and are allowed for roles holding the rpc:<name> permission.
+func (a *App) HandleRPC(name string, handler RPCHandler) {
+	a.rpcMu.Lock()
+	defer a.rpcMu.Unlock()
+	if a.rpc == nil {
+		a.rpc = make(map[string]RPCHandler)
+	}
+	a.rpc[name] = handler
+}
+
+// rpcHandler returns the handler registered for name, if any.
+func (a *App) rpcHandler(name string) (RPCHandler, bool) {
+	a.rpcMu.RLock()
+	defer a.rpcMu.RUnlock()
+	handler, ok := a.rpc[name]
+	return handler, ok
+}
+
+// Call runs an RPC handler for a received message in its own goroutine
+// and replies with the result or error under the message's id.
+func (c *Conn) Call(handler RPCHandler, data *Message) {
+	go func() {
+		result, err := handler(c.ctx, c, data.Payload)
+		if err != nil {
+			c.SendError(data, err)
+			return
+		}
+		c.SendResult(data, result)
+	}()
+}
+
+// SendResult answers a received message with a result event carrying
+// the message's id, sent to this connection only.
+func (c *Conn) SendResult(data *Message, result interface{}) {
+	payload, err := json.Marshal(result)
+	if err != nil {
+		log.Println("error encoding rpc result: ", err)
+		c.SendError(data, err)
+		return
+	}
+	c.Send(&Message{
+		Room:    data.Room,
+		Event:   "result",
+		ID:      data.ID,
+		Payload: payload,
+	})
+}
@@ -0,0 +1,96 @@
+//    Title: security.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CheckOrigin reports whether a WebSocket connection may be opened by the
+// page that sent r. Requests without an Origin header, which browsers always
+// send, are allowed. Otherwise the origin must be listed in the origins block
+// of config.json, where "*" allows any origin, or, without that block,
+// match the host r was sent to.
+func (a *App) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(a.Origins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range a.Origins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// newCSRFToken creates a random token for a session.
+// It returns the token or an error.
+func newCSRFToken() (string, error) {
+	return randomToken()
+}
+
+// randomToken creates a random, hex encoded 32 byte token.
+// It returns the token or an error.
+func randomToken() (string, error) {
+	randombytes := make([]byte, 32)
+	if _, err := rand.Read(randombytes); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", randombytes), nil
+}
+
+// CSRFToken returns the CSRF token of a session, giving one to sessions
+// started before tokens were issued.
+// It returns the token or an error.
+func (a *App) CSRFToken(s *Session) (string, error) {
+	if s.CSRF != "" {
+		return s.CSRF, nil
+	}
+	token, err := newCSRFToken()
+	if err != nil {
+		return "", err
+	}
+	s.CSRF = token
+	if err := a.SessionManager.Touch(s); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// CheckCSRF reports whether a request carries the CSRF token of the current
+// session, in the X-CSRF-Token header or the csrf form field.
+func (a *App) CheckCSRF(w http.ResponseWriter, r *http.Request) bool {
+	s := a.CurrentSession(w, r)
+	if s == nil || s.CSRF == "" {
+		return false
+	}
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.FormValue("csrf")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRF)) == 1
+}
@@ -0,0 +1,400 @@
+//    Title: sessions.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Session is the server-side state of a visitor.
+// Only its ID is stored in the visitor's cookie; CSRF is the token
+// the visitor's forms must send back.
+type Session struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Privilege string    `json:"privilege"`
+	CSRF      string    `json:"csrf"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// SessionInfo describes a session without the secrets that would let
+// whoever reads it use the session: ID is derived from the session's ID
+// and CSRF token is left out.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Privilege string    `json:"privilege"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// PublicID returns an id naming the session that cannot be used as its ID.
+func (s *Session) PublicID() string {
+	sum := sha256.Sum256([]byte(s.ID))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Info returns the description of the session that may be shown to others.
+func (s *Session) Info() SessionInfo {
+	return SessionInfo{
+		ID:        s.PublicID(),
+		Username:  s.Username,
+		Privilege: s.Privilege,
+		Created:   s.Created,
+		LastSeen:  s.LastSeen,
+	}
+}
+
+// SessionManager keeps sessions in a table of a Store and expires them
+// after a period of inactivity or a fixed lifetime.
+type SessionManager struct {
+	app      *App
+	store    Store
+	table    string
+	idle     time.Duration
+	absolute time.Duration
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewSessionManager creates a session manager keeping sessions in table of store.
+// An idle or absolute timeout of zero disables that timeout.
+// It returns the new session manager.
+func NewSessionManager(app *App, store Store, table string, idle time.Duration, absolute time.Duration) *SessionManager {
+	return &SessionManager{
+		app:      app,
+		store:    store,
+		table:    table,
+		idle:     idle,
+		absolute: absolute,
+		done:     make(chan struct{}),
+	}
+}
+
+// purgeEvery purges expired sessions at every interval until the
+// session manager is stopped.
+func (m *SessionManager) purgeEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.Purge(); err != nil {
+				log.Println("error purging sessions: ", err)
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// Stop stops purging expired sessions.
+// It is safe to call more than once.
+func (m *SessionManager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.done)
+	})
+}
+
+// sessionTable returns the name of the table holding the sessions.
+func (a *App) sessionTable() string {
+	if table := a.Sessions["table"]; table != "" {
+		return table
+	}
+	return "sessions"
+}
+
+// openSessions creates the session manager from the sessions block of config.json.
+// Sessions are kept in the database named by its db field, or in memory.
+// It returns an error if the block is invalid.
+func (a *App) openSessions() error {
+	var err error
+	timeouts := map[string]time.Duration{"idle": 30 * time.Minute, "absolute": 24 * time.Hour}
+	for name := range timeouts {
+		if val, ok := a.Sessions[name]; ok {
+			if timeouts[name], err = time.ParseDuration(val); err != nil {
+				return fmt.Errorf("sessions: %v", err)
+			}
+		}
+	}
+	var store Store
+	if name := a.Sessions["db"]; name != "" {
+		db, exists := a.DBManager[name]
+		if !exists {
+			return fmt.Errorf("the sessions database does not exist: %s", name)
+		}
+		store = db.Store()
+	} else {
+		store = NewMemoryStore("")
+		if err := store.Start([]string{a.sessionTable()}); err != nil {
+			return err
+		}
+	}
+	a.SessionManager = NewSessionManager(a, store, a.sessionTable(), timeouts["idle"], timeouts["absolute"])
+	go a.SessionManager.purgeEvery(10 * time.Minute)
+	return nil
+}
+
+// Create starts a new session for a user.
+// It returns the new session or an error.
+func (m *SessionManager) Create(username string, privilege string) (*Session, error) {
+	randombytes := make([]byte, 32)
+	if _, err := rand.Read(randombytes); err != nil {
+		return nil, err
+	}
+	token, err := newCSRFToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	s := &Session{
+		ID:        fmt.Sprintf("%x", randombytes),
+		Username:  username,
+		Privilege: privilege,
+		CSRF:      token,
+		Created:   now,
+		LastSeen:  now,
+	}
+	if err := m.store.InsertObj(m.table, s.ID, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// decode converts an object read from the store into a session.
+func decodeSession(obj interface{}) (*Session, error) {
+	blob, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{}
+	if err := json.Unmarshal(blob, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// expired reports whether a session has timed out.
+func (m *SessionManager) expired(s *Session) bool {
+	now := time.Now()
+	return (m.idle > 0 && now.Sub(s.LastSeen) > m.idle) || (m.absolute > 0 && now.Sub(s.Created) > m.absolute)
+}
+
+// Get reads a session that has not timed out.
+// It returns the session or an error.
+func (m *SessionManager) Get(id string) (*Session, error) {
+	if id == "" {
+		return nil, errors.New("Session does not exist.")
+	}
+	obj, err := m.store.GetObj(m.table, id)
+	if err != nil {
+		return nil, errors.New("Session does not exist.")
+	}
+	s, err := decodeSession(obj)
+	if err != nil {
+		return nil, err
+	}
+	if m.expired(s) {
+		m.Revoke(id)
+		return nil, errors.New("Session expired.")
+	}
+	return s, nil
+}
+
+// Touch records activity on a session, postponing its idle timeout.
+// It may return an error.
+func (m *SessionManager) Touch(s *Session) error {
+	s.LastSeen = time.Now().UTC()
+	return m.store.UpdateObj(m.table, s.ID, s)
+}
+
+// touchInterval returns how often activity on a WebSocket connection is
+// recorded on its session: every minute, or twice per idle timeout if shorter.
+func (m *SessionManager) touchInterval() time.Duration {
+	if m.idle > 0 && m.idle/2 < time.Minute {
+		return m.idle / 2
+	}
+	return time.Minute
+}
+
+// touchSession records activity on the connection's session, at most once
+// per touch interval, so that sessions in use over a socket do not time out.
+// It must be called from the connection's ReadPump.
+func (c *Conn) touchSession() {
+	m := c.app.SessionManager
+	if c.session == "" || m == nil || time.Since(c.touched) < m.touchInterval() {
+		return
+	}
+	c.touched = time.Now()
+	s, err := m.Get(c.session)
+	if err != nil {
+		return
+	}
+	if err := m.Touch(s); err != nil {
+		log.Println("error touching session: ", err)
+	}
+}
+
+// All lists the sessions that have not timed out.
+// It returns the sessions or an error.
+func (m *SessionManager) All() ([]*Session, error) {
+	objs, err := m.store.GetAllObjs(m.table)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*Session, 0, len(objs))
+	for _, obj := range objs {
+		collect, ok := obj.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		s, err := decodeSession(collect["data"])
+		if err != nil || m.expired(s) {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// Infos lists the sessions that have not timed out, without their secrets.
+// It returns the descriptions of the sessions or an error.
+func (m *SessionManager) Infos() ([]SessionInfo, error) {
+	sessions, err := m.All()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, s.Info())
+	}
+	return infos, nil
+}
+
+// RevokePublic ends the session whose PublicID is id, if it has not timed out.
+// It returns an error if there is none.
+func (m *SessionManager) RevokePublic(id string) error {
+	sessions, err := m.All()
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if subtle.ConstantTimeCompare([]byte(s.PublicID()), []byte(id)) == 1 {
+			return m.Revoke(s.ID)
+		}
+	}
+	return errors.New("Session does not exist.")
+}
+
+// Purge removes every session that has timed out.
+// It may return an error.
+func (m *SessionManager) Purge() error {
+	objs, err := m.store.GetAllObjs(m.table)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		collect, ok := obj.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		s, err := decodeSession(collect["data"])
+		if err != nil || m.expired(s) {
+			m.Revoke(fmt.Sprint(collect["hash"]))
+		}
+	}
+	return nil
+}
+
+// Revoke ends a session and closes every WebSocket connection opened with it.
+// It may return an error.
+func (m *SessionManager) Revoke(id string) error {
+	err := m.store.DeleteObj(m.table, id)
+	for _, c := range m.app.Conns() {
+		if c.session == id {
+			c.Close()
+		}
+	}
+	return err
+}
+
+// CurrentSession reads the session named in the request's cookie.
+// It returns nil if there is no valid session.
+func (a *App) CurrentSession(w http.ResponseWriter, r *http.Request) *Session {
+	cookie := a.ReadCookieHandler(w, r, a.Cookiename)
+	if cookie == nil {
+		return nil
+	}
+	s, err := a.SessionManager.Get(cookie["session"])
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+// StartSession starts a new session for a user, ending the request's current
+// session, if any, and sets the session cookie.
+// The new session's CSRF token is sent in the X-CSRF-Token response header.
+// It returns the new session or an error.
+func (a *App) StartSession(w http.ResponseWriter, r *http.Request, username string, privilege string) (*Session, error) {
+	if old := a.CurrentSession(w, r); old != nil {
+		a.SessionManager.Revoke(old.ID)
+	}
+	s, err := a.SessionManager.Create(username, privilege)
+	if err != nil {
+		return nil, err
+	}
+	a.SetCookieHandler(w, r, a.Cookiename, map[string]string{
+		"session": s.ID,
+	})
+	w.Header().Set("X-CSRF-Token", s.CSRF)
+	return s, nil
+}
+
+// LogoutHandler ends the current session and only parses POST requests
+// carrying the session's CSRF token.
+func (a *App) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if !a.CheckCSRF(w, r) {
+		http.Error(w, "Invalid CSRF token.", 403)
+		return
+	}
+	if s := a.CurrentSession(w, r); s != nil {
+		a.SessionManager.Revoke(s.ID)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   a.Cookiename,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+	w.WriteHeader(200)
+}
@@ -0,0 +1,116 @@
+//    Title: sessions_test.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnTouchSession(t *testing.T) {
+	app := newTestApp(t, "")
+	m := app.SessionManager
+	s, err := m.Create("alice", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().UTC().Add(-10 * time.Minute)
+	s.LastSeen = old
+	if err := m.store.UpdateObj(m.table, s.ID, s); err != nil {
+		t.Fatal(err)
+	}
+	c := &Conn{app: app, session: s.ID}
+	c.touchSession()
+	got, err := m.Get(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.LastSeen.After(old) {
+		t.Fatalf("LastSeen not updated: %s", got.LastSeen)
+	}
+	touched := got.LastSeen
+	c.touchSession()
+	if got, _ = m.Get(s.ID); !got.LastSeen.Equal(touched) {
+		t.Error("session touched twice within the touch interval")
+	}
+}
+
+func TestSessionInfosRedacted(t *testing.T) {
+	app := newTestApp(t, "")
+	m := app.SessionManager
+	s, err := m.Create("alice", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := m.Infos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, _ := json.Marshal(infos)
+	if strings.Contains(string(blob), s.ID) || strings.Contains(string(blob), s.CSRF) {
+		t.Fatalf("session secrets listed: %s", blob)
+	}
+	if len(infos) != 1 || infos[0].ID != s.PublicID() {
+		t.Fatalf("got %s", blob)
+	}
+	if err := m.RevokePublic(s.ID); err == nil {
+		t.Error("revoking by session ID succeeded")
+	}
+	if err := m.RevokePublic(infos[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(s.ID); err == nil {
+		t.Error("session not revoked")
+	}
+}
+
+func TestSessionPurgeStops(t *testing.T) {
+	app := newTestApp(t, "")
+	m := app.SessionManager
+	s, err := m.Create("alice", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.LastSeen = time.Now().UTC().Add(-time.Hour)
+	if err := m.store.UpdateObj(m.table, s.ID, s); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		m.purgeEvery(time.Millisecond)
+		close(stopped)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := m.store.GetObj(m.table, s.ID); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired session not purged")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	app.Stop()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("purging goes on after App.Stop")
+	}
+	m.Stop()
+}
@@ -49,6 +49,28 @@ var Base = (function Base(global) {
         }
     };
 
+/**
+ * rtgo.logout
+ * End the current session, sending its CSRF token, and reload the page with a guest session.
+ */
+    rtgo.logout = function logout() {
+        var meta = document.querySelector('meta[name="csrf-token"]');
+
+        clean.xhrReq({
+            url: global.location.protocol + '//' + global.location.hostname + ':' + global.location.port + '/logout',
+            method: 'post',
+            headers: {
+                'X-CSRF-Token': meta ? meta.getAttribute('content') : ''
+            },
+            success: function () {
+                global.location.reload();
+            },
+            failure: function (e) {
+                console.log('Logout failed: ' + e);
+            }
+        });
+    };
+
 /**
  * rtgo.hideForms
  * Hide all forms.
@@ -20,6 +20,24 @@ var Login = (function Login(global) {
 
     var submit = clean('.form-button');
 
+/**
+ * csrfToken
+ * Read or replace the CSRF token of the session, kept in the csrf-token meta tag.
+ * @param {String} token the new token, if any
+ * @return {String} token
+ */
+    function csrfToken(token) {
+        var meta = document.querySelector('meta[name="csrf-token"]');
+
+        if (!meta) {
+            return '';
+        }
+        if (token) {
+            meta.setAttribute('content', token);
+        }
+        return meta.getAttribute('content');
+    }
+
 /**
  * sendForm
  * Send the form data to the server via an XHR.
@@ -36,11 +54,13 @@ var Login = (function Login(global) {
         if (values.type === 'register') {
             fd.append('email', values.email);
         }
+        fd.append('csrf', csrfToken());
         clean.xhrReq({
             url: global.location.protocol + '//' + global.location.hostname + ':' + global.location.port + '/' + values.type,
             method: 'post',
             data: fd,
             success: function (e, xhr, response) {
+                csrfToken(xhr.getResponseHeader('X-CSRF-Token'));
                 console.log('Login success: ' + response);
             },
             failure: function (e, xhr) {
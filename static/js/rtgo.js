@@ -18,21 +18,21 @@
 (function (global) {
     'use strict';
 
-    var wsurl = (global.location.protocol === 'http:' ? 'ws://' : 'wss://') + global.location.host + '/ws',
-        dbs = ['riak', 'postgresql', 'mysql', 'sqlite3'];
+    var wsurl = (global.location.protocol === 'http:' ? 'ws://' : 'wss://') + global.location.host + '/ws';
 
 /**
  * RTGo
  * Contructor of RTGo.
  * @params {String} url
+ * @params {String} protocol subprotocol selecting the codec, see wsrooms
  */
-    function RTGo(url) {
+    function RTGo(url, protocol) {
         if (typeof url === 'string') {
             this.controllers = {};
             this.hash = '';
             this.view = document.querySelector('[data-rt-view]');
             this.hrefs = document.querySelectorAll('[data-rt-href]');
-            this.socket = wsrooms(url);
+            this.socket = wsrooms(url, protocol);
             this.socket.on('open', this.onopen.bind(this));
             this.socket.on('close', this.onclose.bind(this));
             this.socket.on('error', this.onerror.bind(this));
@@ -99,9 +99,15 @@
 
 /**
  * RTGo.onerror
- * Called when the WebSocket connection encounters an error.
+ * Called when the WebSocket connection encounters an error,
+ * or when the server sends an error event with a code, message,
+ * event and id.
  */
     RTGo.prototype.onerror = function onerror(e) {
+        if (e && e.code) {
+            console.log('server error:', e.code, e.message, e.event);
+            return;
+        }
         console.log('socket error:', e);
     };
 
@@ -146,7 +152,7 @@
  * which query the databases on the server.
  */
     function checkParams(db, table, key) {
-        return db && typeof db === 'string' && dbs.indexOf(db) !== -1 &&
+        return db && typeof db === 'string' &&
                 table && typeof table === 'string' &&
                 key && typeof key === 'string';
     }
@@ -156,15 +162,17 @@
  * @param {String} db
  * @param {String} table
  * @param {String} key
+ * @return {Promise} resolved when the server replies
  */
     RTGo.prototype.getObj = function getObj(db, table, key) {
         if (checkParams(db, table, key)) {
-            this.socket.send("getObj", {
+            return this.socket.call('root', "getObj", {
                 db: db,
                 table: table,
                 key: key
             });
         }
+        return Promise.reject(new Error('Invalid parameters.'));
     };
 
 /**
@@ -173,19 +181,58 @@
  * @param {String} table
  * @param {String} key
  * @param {String || Number || Boolean || Array || Object || null} data
+ * @return {Promise} resolved when the server replies
  */
     RTGo.prototype.insertObj = function insertObj(db, table, key, data) {
         if (checkParams(db, table, key)) {
-            try {
-                data = JSON.stringify(data);
-            } catch (ignore) {}
-            this.socket.send("insertObj", {
+            return this.socket.call('root', "insertObj", {
                 db: db,
                 table: table,
                 key: key,
                 data: data
             });
         }
+        return Promise.reject(new Error('Invalid parameters.'));
+    };
+
+/**
+ * RTGo.updateObj
+ * @param {String} db
+ * @param {String} table
+ * @param {String} key
+ * @param {String || Number || Boolean || Array || Object || null} data
+ * @return {Promise} resolved when the server replies
+ */
+    RTGo.prototype.updateObj = function updateObj(db, table, key, data) {
+        if (checkParams(db, table, key)) {
+            return this.socket.call('root', "updateObj", {
+                db: db,
+                table: table,
+                key: key,
+                data: data
+            });
+        }
+        return Promise.reject(new Error('Invalid parameters.'));
+    };
+
+/**
+ * RTGo.upsertObj
+ * @param {String} db
+ * @param {String} table
+ * @param {String} key
+ * @param {String || Number || Boolean || Array || Object || null} data
+ * @return {Promise} resolved when the server replies
+ */
+    RTGo.prototype.upsertObj = function upsertObj(db, table, key, data) {
+        if (checkParams(db, table, key)) {
+            return this.socket.call('root', "upsertObj", {
+                db: db,
+                table: table,
+                key: key,
+                data: data
+            });
+        }
+        return Promise.reject(new Error('Invalid parameters.'));
     };
 
 /**
@@ -193,15 +240,86 @@
  * @param {String} db
  * @param {String} table
  * @param {String} key
+ * @return {Promise} resolved when the server replies
  */
     RTGo.prototype.deleteObj = function deleteObj(db, table, key) {
         if (checkParams(db, table, key)) {
-            this.socket.send("deleteObj", {
+            return this.socket.call('root', "deleteObj", {
                 db: db,
                 table: table,
                 key: key
             });
         }
+        return Promise.reject(new Error('Invalid parameters.'));
+    };
+
+/**
+ * RTGo.call
+ * Call an RPC handler registered on the server with app.HandleRPC.
+ * @param {String} name
+ * @param {String || Array || Object || Boolean || Number || null} payload
+ * @param {Number} timeout
+ * @return {Promise} resolved with the handler's result or rejected with its error
+ */
+    RTGo.prototype.call = function call(name, payload, timeout) {
+        return this.socket.call('root', name, payload, timeout);
+    };
+
+/**
+ * RTGo.subscribe
+ * Receive objInserted, objUpdated and objDeleted events when a table,
+ * or a single object if key is given, changes.
+ * If room is given, the events are sent to every member of that room.
+ * @param {String} db
+ * @param {String} table
+ * @param {String} key
+ * @param {String} room
+ */
+    RTGo.prototype.subscribe = function subscribe(db, table, key, room) {
+        if (checkParams(db, table, key || '-')) {
+            this.socket.send(room || 'root', 'subscribe', {
+                db: db,
+                table: table,
+                key: key || ''
+            });
+        }
+    };
+
+/**
+ * RTGo.unsubscribe
+ * Stop receiving the events enabled by RTGo.subscribe.
+ * @param {String} db
+ * @param {String} table
+ * @param {String} key
+ * @param {String} room
+ */
+    RTGo.prototype.unsubscribe = function unsubscribe(db, table, key, room) {
+        if (checkParams(db, table, key || '-')) {
+            this.socket.send(room || 'root', 'unsubscribe', {
+                db: db,
+                table: table,
+                key: key || ''
+            });
+        }
+    };
+
+/**
+ * RTGo.listSessions
+ * Request the list of active sessions; it is received in a 'sessions' event.
+ */
+    RTGo.prototype.listSessions = function listSessions() {
+        this.socket.send('listSessions', null);
+    };
+
+/**
+ * RTGo.killSession
+ * End a session, closing every socket opened with it.
+ * @param {String} id the id listed by listSessions
+ */
+    RTGo.prototype.killSession = function killSession(id) {
+        if (id && typeof id === 'string') {
+            this.socket.send('killSession', id);
+        }
     };
 
     global.rtgo = new RTGo(wsurl);
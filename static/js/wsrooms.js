@@ -18,27 +18,638 @@
 (function (global) {
     'use strict';
 
+/**
+ * utf8
+ * Encodes a string into UTF-8 bytes and decodes them back.
+ */
+    var utf8 = {
+        encode: function (str) {
+            return new TextEncoder().encode(str);
+        },
+        decode: function (bytes) {
+            return new TextDecoder().decode(bytes);
+        }
+    };
+
+/**
+ * toBytes
+ * Converts an ArrayBuffer or typed array into a Uint8Array;
+ * returns null for any other value.
+ * @param {ArrayBuffer || ArrayBufferView} data
+ * @return {Uint8Array}
+ */
+    function toBytes(data) {
+        if (data instanceof Uint8Array) {
+            return data;
+        }
+        if (data instanceof ArrayBuffer) {
+            return new Uint8Array(data);
+        }
+        if (data && ArrayBuffer.isView(data)) {
+            return new Uint8Array(data.buffer, data.byteOffset, data.byteLength);
+        }
+        return null;
+    }
+
+/**
+ * Writer
+ * Growable byte buffer used by the binary encoders.
+ */
+    function Writer() {
+        this.bytes = new Uint8Array(256);
+        this.view = new DataView(this.bytes.buffer);
+        this.length = 0;
+    }
+
+    Writer.prototype.reserve = function reserve(n) {
+        var bytes;
+
+        if (this.length + n <= this.bytes.length) {
+            return;
+        }
+        bytes = new Uint8Array(Math.max(this.bytes.length * 2, this.length + n));
+        bytes.set(this.bytes);
+        this.bytes = bytes;
+        this.view = new DataView(bytes.buffer);
+    };
+
+    Writer.prototype.uint = function uint(value, size) {
+        this.reserve(size);
+        switch (size) {
+            case 1:
+                this.view.setUint8(this.length, value);
+                break;
+            case 2:
+                this.view.setUint16(this.length, value);
+                break;
+            case 4:
+                this.view.setUint32(this.length, value);
+                break;
+            case 8:
+                this.view.setUint32(this.length, Math.floor(value / 4294967296));
+                this.view.setUint32(this.length + 4, value % 4294967296);
+                break;
+        }
+        this.length += size;
+    };
+
+    Writer.prototype.float64 = function float64(value) {
+        this.reserve(8);
+        this.view.setFloat64(this.length, value);
+        this.length += 8;
+    };
+
+    Writer.prototype.write = function write(bytes) {
+        this.reserve(bytes.length);
+        this.bytes.set(bytes, this.length);
+        this.length += bytes.length;
+    };
+
+    Writer.prototype.result = function result() {
+        return this.bytes.slice(0, this.length);
+    };
+
+/**
+ * Reader
+ * Cursor over the bytes read by the binary decoders.
+ * @param {Uint8Array} bytes
+ */
+    function Reader(bytes) {
+        this.bytes = bytes;
+        this.view = new DataView(bytes.buffer, bytes.byteOffset, bytes.byteLength);
+        this.offset = 0;
+    }
+
+    Reader.prototype.uint = function uint(size) {
+        var value;
+
+        if (this.offset + size > this.bytes.length) {
+            throw new Error('Unexpected end of message.');
+        }
+        switch (size) {
+            case 1:
+                value = this.view.getUint8(this.offset);
+                break;
+            case 2:
+                value = this.view.getUint16(this.offset);
+                break;
+            case 4:
+                value = this.view.getUint32(this.offset);
+                break;
+            case 8:
+                value = this.view.getUint32(this.offset) * 4294967296 + this.view.getUint32(this.offset + 4);
+                break;
+        }
+        this.offset += size;
+        return value;
+    };
+
+    Reader.prototype.int = function int(size) {
+        var value;
+
+        if (size === 8) {
+            value = this.view.getInt32(this.offset) * 4294967296 + this.view.getUint32(this.offset + 4);
+            this.offset += 8;
+            return value;
+        }
+        value = this.uint(size);
+        return value >= Math.pow(2, size * 8 - 1) ? value - Math.pow(2, size * 8) : value;
+    };
+
+    Reader.prototype.float = function float(size) {
+        var value;
+
+        if (this.offset + size > this.bytes.length) {
+            throw new Error('Unexpected end of message.');
+        }
+        value = size === 4 ? this.view.getFloat32(this.offset) : this.view.getFloat64(this.offset);
+        this.offset += size;
+        return value;
+    };
+
+    Reader.prototype.read = function read(n) {
+        var bytes;
+
+        if (this.offset + n > this.bytes.length) {
+            throw new Error('Unexpected end of message.');
+        }
+        bytes = this.bytes.slice(this.offset, this.offset + n);
+        this.offset += n;
+        return bytes;
+    };
+
+/**
+ * msgpack
+ * MessagePack encoder and decoder for the rtgo.msgpack subprotocol.
+ */
+    var msgpack = {
+        encode: function (value, w) {
+            var bytes,
+                keys,
+                x;
+
+            if (value === null || value === undefined) {
+                w.uint(0xc0, 1);
+            } else if (value === false || value === true) {
+                w.uint(value ? 0xc3 : 0xc2, 1);
+            } else if (typeof value === 'number') {
+                if (Number.isSafeInteger(value) && value >= 0) {
+                    if (value < 128) {
+                        w.uint(value, 1);
+                    } else if (value < 256) {
+                        w.uint(0xcc, 1);
+                        w.uint(value, 1);
+                    } else if (value < 65536) {
+                        w.uint(0xcd, 1);
+                        w.uint(value, 2);
+                    } else if (value < 4294967296) {
+                        w.uint(0xce, 1);
+                        w.uint(value, 4);
+                    } else {
+                        w.uint(0xcf, 1);
+                        w.uint(value, 8);
+                    }
+                } else if (Number.isSafeInteger(value) && value >= -2147483648) {
+                    if (value >= -32) {
+                        w.uint(value & 0xff, 1);
+                    } else if (value >= -128) {
+                        w.uint(0xd0, 1);
+                        w.uint(value & 0xff, 1);
+                    } else if (value >= -32768) {
+                        w.uint(0xd1, 1);
+                        w.uint(value & 0xffff, 2);
+                    } else {
+                        w.uint(0xd2, 1);
+                        w.uint(value >>> 0, 4);
+                    }
+                } else {
+                    w.uint(0xcb, 1);
+                    w.float64(value);
+                }
+            } else if (typeof value === 'string') {
+                bytes = utf8.encode(value);
+                if (bytes.length < 32) {
+                    w.uint(0xa0 | bytes.length, 1);
+                } else if (bytes.length < 256) {
+                    w.uint(0xd9, 1);
+                    w.uint(bytes.length, 1);
+                } else if (bytes.length < 65536) {
+                    w.uint(0xda, 1);
+                    w.uint(bytes.length, 2);
+                } else {
+                    w.uint(0xdb, 1);
+                    w.uint(bytes.length, 4);
+                }
+                w.write(bytes);
+            } else if (toBytes(value)) {
+                bytes = toBytes(value);
+                if (bytes.length < 256) {
+                    w.uint(0xc4, 1);
+                    w.uint(bytes.length, 1);
+                } else if (bytes.length < 65536) {
+                    w.uint(0xc5, 1);
+                    w.uint(bytes.length, 2);
+                } else {
+                    w.uint(0xc6, 1);
+                    w.uint(bytes.length, 4);
+                }
+                w.write(bytes);
+            } else if (Array.isArray(value)) {
+                msgpack.head(w, 0x90, 0xdc, value.length);
+                for (x = 0; x < value.length; x += 1) {
+                    msgpack.encode(value[x], w);
+                }
+            } else {
+                keys = Object.keys(value).filter(function (key) {
+                    return value[key] !== undefined;
+                });
+                msgpack.head(w, 0x80, 0xde, keys.length);
+                for (x = 0; x < keys.length; x += 1) {
+                    msgpack.encode(keys[x], w);
+                    msgpack.encode(value[keys[x]], w);
+                }
+            }
+        },
+        head: function (w, fix, code, length) {
+            if (length < 16) {
+                w.uint(fix | length, 1);
+            } else if (length < 65536) {
+                w.uint(code, 1);
+                w.uint(length, 2);
+            } else {
+                w.uint(code + 1, 1);
+                w.uint(length, 4);
+            }
+        },
+        decode: function (r) {
+            var code = r.uint(1);
+
+            if (code < 0x80) {
+                return code;
+            }
+            if (code < 0x90) {
+                return msgpack.map(r, code & 0x0f);
+            }
+            if (code < 0xa0) {
+                return msgpack.array(r, code & 0x0f);
+            }
+            if (code < 0xc0) {
+                return utf8.decode(r.read(code & 0x1f));
+            }
+            if (code >= 0xe0) {
+                return code - 256;
+            }
+            switch (code) {
+                case 0xc0:
+                    return null;
+                case 0xc2:
+                    return false;
+                case 0xc3:
+                    return true;
+                case 0xc4:
+                case 0xc5:
+                case 0xc6:
+                    return r.read(r.uint(1 << (code - 0xc4)));
+                case 0xca:
+                    return r.float(4);
+                case 0xcb:
+                    return r.float(8);
+                case 0xcc:
+                case 0xcd:
+                case 0xce:
+                case 0xcf:
+                    return r.uint(1 << (code - 0xcc));
+                case 0xd0:
+                case 0xd1:
+                case 0xd2:
+                case 0xd3:
+                    return r.int(1 << (code - 0xd0));
+                case 0xd9:
+                case 0xda:
+                case 0xdb:
+                    return utf8.decode(r.read(r.uint(1 << (code - 0xd9))));
+                case 0xdc:
+                case 0xdd:
+                    return msgpack.array(r, r.uint(code === 0xdc ? 2 : 4));
+                case 0xde:
+                case 0xdf:
+                    return msgpack.map(r, r.uint(code === 0xde ? 2 : 4));
+            }
+            throw new Error('Unsupported MessagePack code ' + code + '.');
+        },
+        array: function (r, length) {
+            var value = [],
+                x;
+
+            for (x = 0; x < length; x += 1) {
+                value.push(msgpack.decode(r));
+            }
+            return value;
+        },
+        map: function (r, length) {
+            var value = {},
+                x;
+
+            for (x = 0; x < length; x += 1) {
+                value[String(msgpack.decode(r))] = msgpack.decode(r);
+            }
+            return value;
+        }
+    };
+
+/**
+ * cbor
+ * CBOR encoder and decoder for the rtgo.cbor subprotocol.
+ */
+    var cbor = {
+        head: function (w, major, length) {
+            if (length < 24) {
+                w.uint(major << 5 | length, 1);
+            } else if (length < 256) {
+                w.uint(major << 5 | 24, 1);
+                w.uint(length, 1);
+            } else if (length < 65536) {
+                w.uint(major << 5 | 25, 1);
+                w.uint(length, 2);
+            } else if (length < 4294967296) {
+                w.uint(major << 5 | 26, 1);
+                w.uint(length, 4);
+            } else {
+                w.uint(major << 5 | 27, 1);
+                w.uint(length, 8);
+            }
+        },
+        encode: function (value, w) {
+            var bytes,
+                keys,
+                x;
+
+            if (value === null || value === undefined) {
+                w.uint(0xf6, 1);
+            } else if (value === false || value === true) {
+                w.uint(value ? 0xf5 : 0xf4, 1);
+            } else if (typeof value === 'number') {
+                if (Number.isSafeInteger(value)) {
+                    cbor.head(w, value < 0 ? 1 : 0, value < 0 ? -1 - value : value);
+                } else {
+                    w.uint(0xfb, 1);
+                    w.float64(value);
+                }
+            } else if (typeof value === 'string') {
+                bytes = utf8.encode(value);
+                cbor.head(w, 3, bytes.length);
+                w.write(bytes);
+            } else if (toBytes(value)) {
+                bytes = toBytes(value);
+                cbor.head(w, 2, bytes.length);
+                w.write(bytes);
+            } else if (Array.isArray(value)) {
+                cbor.head(w, 4, value.length);
+                for (x = 0; x < value.length; x += 1) {
+                    cbor.encode(value[x], w);
+                }
+            } else {
+                keys = Object.keys(value).filter(function (key) {
+                    return value[key] !== undefined;
+                });
+                cbor.head(w, 5, keys.length);
+                for (x = 0; x < keys.length; x += 1) {
+                    cbor.encode(keys[x], w);
+                    cbor.encode(value[keys[x]], w);
+                }
+            }
+        },
+        half: function (bits) {
+            var exponent = (bits >> 10) & 0x1f,
+                fraction = bits & 0x3ff,
+                sign = bits & 0x8000 ? -1 : 1;
+
+            if (exponent === 0) {
+                return sign * Math.pow(2, -14) * (fraction / 1024);
+            }
+            if (exponent === 0x1f) {
+                return fraction ? NaN : sign * Infinity;
+            }
+            return sign * Math.pow(2, exponent - 15) * (1 + fraction / 1024);
+        },
+        decode: function (r) {
+            var initial = r.uint(1),
+                major = initial >> 5,
+                info = initial & 0x1f,
+                length = info,
+                value,
+                x;
+
+            if (major === 7) {
+                switch (info) {
+                    case 20:
+                        return false;
+                    case 21:
+                        return true;
+                    case 22:
+                    case 23:
+                        return null;
+                    case 25:
+                        return cbor.half(r.uint(2));
+                    case 26:
+                        return r.float(4);
+                    case 27:
+                        return r.float(8);
+                }
+                throw new Error('Unsupported CBOR simple value ' + info + '.');
+            }
+            if (info >= 24 && info <= 27) {
+                length = r.uint(1 << (info - 24));
+            } else if (info > 27) {
+                throw new Error('Unsupported CBOR length ' + info + '.');
+            }
+            switch (major) {
+                case 0:
+                    return length;
+                case 1:
+                    return -1 - length;
+                case 2:
+                    return r.read(length);
+                case 3:
+                    return utf8.decode(r.read(length));
+                case 4:
+                    value = [];
+                    for (x = 0; x < length; x += 1) {
+                        value.push(cbor.decode(r));
+                    }
+                    return value;
+                case 5:
+                    value = {};
+                    for (x = 0; x < length; x += 1) {
+                        value[String(cbor.decode(r))] = cbor.decode(r);
+                    }
+                    return value;
+                case 6:
+                    return cbor.decode(r);
+            }
+        }
+    };
+
+/**
+ * base64
+ * Encodes bytes into base64 and decodes them back, for attachments sent with JSON.
+ */
+    var base64 = {
+        encode: function (bytes) {
+            var str = '',
+                x;
+
+            for (x = 0; x < bytes.length; x += 1) {
+                str += String.fromCharCode(bytes[x]);
+            }
+            return global.btoa(str);
+        },
+        decode: function (str) {
+            var raw = global.atob(str),
+                bytes = new Uint8Array(raw.length),
+                x;
+
+            for (x = 0; x < raw.length; x += 1) {
+                bytes[x] = raw.charCodeAt(x);
+            }
+            return bytes;
+        }
+    };
+
+/**
+ * binaryCodec
+ * Creates a codec writing binary frames with an encoder and decoder.
+ * @param {Object} format msgpack or cbor
+ * @return {Object} codec
+ */
+    function binaryCodec(format) {
+        return {
+            binary: true,
+            encode: function (data) {
+                var w = new Writer();
+
+                format.encode(data, w);
+                return w.result();
+            },
+            decode: function (frame) {
+                var bytes = toBytes(frame);
+
+                if (!bytes) {
+                    throw new Error('Expected a binary frame.');
+                }
+                return format.decode(new Reader(bytes));
+            }
+        };
+    }
+
+/**
+ * codecs
+ * The codecs of the subprotocols offered by the server.
+ * Messages are encoded as objects with a room, an event, an optional id,
+ * a payload and an optional binary attachment named data.
+ */
+    var codecs = {
+        'rtgo.json': {
+            binary: false,
+            encode: function (data) {
+                var bytes = toBytes(data.data),
+                    copy = {},
+                    key;
+
+                if (bytes) {
+                    for (key in data) {
+                        if (data.hasOwnProperty(key)) {
+                            copy[key] = data[key];
+                        }
+                    }
+                    copy.data = base64.encode(bytes);
+                    data = copy;
+                }
+                return JSON.stringify(data);
+            },
+            decode: function (frame) {
+                var data = JSON.parse(typeof frame === 'string' ? frame : utf8.decode(toBytes(frame)));
+
+                if (data && typeof data.data === 'string') {
+                    data.data = base64.decode(data.data);
+                }
+                return data;
+            }
+        },
+        'rtgo.msgpack': binaryCodec(msgpack),
+        'rtgo.cbor': binaryCodec(cbor)
+    };
+
 /**
  * WSRooms
  * Contsructor of WSRooms
+ * The subprotocol selects the codec used on the socket: 'rtgo.json' (the default),
+ * 'rtgo.msgpack' or 'rtgo.cbor'; the server may pick the first of several.
+ * Unless reconnect is set to false, a dropped socket is reconnected with an
+ * exponential backoff of at most maxDelay milliseconds; see WSRooms.onclose.
  * @param {String} url
  * @param {String || Array} protocol
  */
-    function WSRooms(url) {
+    function WSRooms(url, protocol) {
         if (!global.WebSocket || typeof url !== 'string') {
             return;
         }
         eventEmitter(this);
+        this.url = url;
+        this.protocol = protocol;
         this.open = false;
+        this.closed = false;
         this.id = null;
+        this.token = null;
         this.members = [];
         this.room = 'root';
         this.rooms = {};
-        this.socket = new WebSocket(url);
+        this.calls = {};
+        this.readers = {};
+        this.writers = {};
+        this.nextId = 1;
+        this.reconnect = true;
+        this.reconnecting = false;
+        this.retries = 0;
+        this.maxDelay = 30000;
+        this.connect();
+    }
+
+/**
+ * WSRooms.connect
+ * Internal method opening the socket, asking the server to resume
+ * the previous connection when it gave a resume token.
+ */
+    WSRooms.prototype.connect = function connect() {
+        var url = this.url;
+
+        if (this.token) {
+            url += (url.indexOf('?') === -1 ? '?' : '&') + 'resume=' + encodeURIComponent(this.token);
+        }
+        this.socket = this.protocol ? new WebSocket(url, this.protocol) : new WebSocket(url);
+        this.socket.binaryType = 'arraybuffer';
         this.socket.onmessage = this.onmessage.bind(this);
         this.socket.onclose = this.onclose.bind(this);
         this.socket.onerror = this.onerror.bind(this);
-    }
+    };
+
+/**
+ * WSRooms.codec
+ * Returns the codec of the subprotocol chosen by the server.
+ * @return {Object} codec
+ */
+    WSRooms.prototype.codec = function codec() {
+        return codecs[this.socket.protocol] || codecs['rtgo.json'];
+    };
+
+/**
+ * WSRooms.write
+ * Internal method encoding a message with the socket's codec and sending it.
+ * @param {Object} data
+ */
+    WSRooms.prototype.write = function write(data) {
+        this.socket.send(this.codec().encode(data));
+    };
 
 /**
  * WSRooms.send
@@ -46,9 +657,10 @@
  * @param {String} room
  * @param {String} event
  * @param {String || Array || Object || Boolean || Number || null} payload
+ * @param {ArrayBuffer || Uint8Array} data binary attachment, optional
  */
-    WSRooms.prototype.send = function send(room, event, payload) {
-        var data = {};
+    WSRooms.prototype.send = function send(room, event, payload, data) {
+        var msg = {};
 
         if (typeof event !== undefined && room && typeof room === 'string' && payload === undefined) {
             payload = event;
@@ -58,27 +670,490 @@
         if (!this.open || typeof room !== 'string' || typeof event !== 'string' || typeof payload === undefined || (room !== 'root' && !this.rooms.hasOwnProperty(room))) {
             return;
         }
-        data.room = room;
-        data.event = event;
-        if (typeof payload !== 'string') {
-            try {
-                payload = JSON.stringify(payload);
-            } catch (ignore) {}
+        msg.room = room;
+        msg.event = event;
+        msg.payload = payload;
+        if (data) {
+            msg.data = data;
+        }
+        this.write(msg);
+    };
+
+/**
+ * WSRooms.call
+ * Send a message expecting a reply, such as a call to an RPC handler.
+ * Returns a promise resolved with the payload of the reply carrying the same id,
+ * or rejected with the payload of an error event.
+ * @param {String} room
+ * @param {String} event
+ * @param {String || Array || Object || Boolean || Number || null} payload
+ * @param {Number} timeout milliseconds to wait for the reply; no limit if omitted
+ * @return {Promise}
+ */
+    WSRooms.prototype.call = function call(room, event, payload, timeout) {
+        var calls = this.calls,
+            write = this.write.bind(this),
+            open = this.open,
+            rooms = this.rooms,
+            id = String(this.nextId++);
+
+        return new Promise(function (resolve, reject) {
+            var data = {};
+
+            if (!open || typeof room !== 'string' || typeof event !== 'string' || (room !== 'root' && !rooms.hasOwnProperty(room))) {
+                return reject(new Error('Cannot send the call.'));
+            }
+            data.room = room;
+            data.event = event;
+            data.id = id;
+            data.payload = payload;
+            calls[id] = {
+                resolve: resolve,
+                reject: reject
+            };
+            if (typeof timeout === 'number') {
+                setTimeout(function () {
+                    if (calls.hasOwnProperty(id)) {
+                        delete calls[id];
+                        reject(new Error('Call timed out.'));
+                    }
+                }, timeout);
+            }
+            write(data);
+        });
+    };
+
+/**
+ * WSRooms.handleReply
+ * Internal method settling the call waiting for a reply with the given id.
+ * Returns true if the reply was only meant for the call.
+ * @param {String} id
+ * @param {String} event
+ * @param {String || Array || Object || Boolean || Number || null} payload
+ * @return {Boolean}
+ */
+    WSRooms.prototype.handleReply = function handleReply(id, event, payload) {
+        var call = this.calls[id];
+
+        if (!call) {
+            return false;
+        }
+        delete this.calls[id];
+        if (event === 'error') {
+            call.reject(payload);
+        } else {
+            call.resolve(payload);
+        }
+        return event === 'result' || event === 'error';
+    };
+
+/**
+ * StreamWriter
+ * Writes a stream announced to the server with WSRooms.stream.
+ * @param {WSRooms} socket
+ * @param {String} id
+ */
+    function StreamWriter(socket, id) {
+        this.socket = socket;
+        this.id = id;
+        this.buffer = new Uint8Array(0);
+        this.acked = 0;
+        this.sent = 0;
+        this.written = 0;
+        this.window = 0;
+        this.chunk = 16384;
+        this.closed = false;
+        this.error = null;
+        this.waiting = [];
+        this.last = Promise.resolve();
+    }
+
+/**
+ * StreamWriter.write
+ * Write bytes, or a string as UTF-8, to the stream.
+ * Returns a promise resolved once the bytes are sent, which waits
+ * while the server has not acknowledged a full window of bytes.
+ * @param {ArrayBuffer || Uint8Array || String} data
+ * @return {Promise}
+ */
+    StreamWriter.prototype.write = function write(data) {
+        var self = this,
+            bytes = toBytes(data) || utf8.encode(String(data));
+
+        this.last = this.last.then(function () {
+            return new Promise(function (resolve, reject) {
+                function next() {
+                    var size,
+                        buffer;
+
+                    if (self.error) {
+                        return reject(self.error);
+                    }
+                    while (bytes.length) {
+                        size = Math.min(bytes.length, self.window - (self.written - self.acked));
+                        if (size <= 0) {
+                            self.waiting.push(next);
+                            return;
+                        }
+                        buffer = new Uint8Array(self.buffer.length + size);
+                        buffer.set(self.buffer);
+                        buffer.set(bytes.subarray(0, size), self.buffer.length);
+                        self.buffer = buffer;
+                        self.written += size;
+                        bytes = bytes.subarray(size);
+                        self.flush();
+                    }
+                    resolve();
+                }
+
+                if (self.closed) {
+                    return reject(new Error('Stream closed.'));
+                }
+                next();
+            });
+        });
+        return this.last;
+    };
+
+/**
+ * StreamWriter.close
+ * End the stream.
+ * Returns a promise resolved once the server has accepted the stream and acknowledged every byte,
+ * or rejected with the error of a refused or aborted stream.
+ * @return {Promise}
+ */
+    StreamWriter.prototype.close = function close() {
+        var self = this;
+
+        this.last = this.last.then(function () {
+            return new Promise(function (resolve, reject) {
+                function next() {
+                    if (self.error) {
+                        return reject(self.error);
+                    }
+                    if (self.window === 0 || self.acked < self.written) {
+                        self.waiting.push(next);
+                        return;
+                    }
+                    delete self.socket.writers[self.id];
+                    resolve();
+                }
+
+                if (!self.closed && !self.error) {
+                    self.closed = true;
+                    self.socket.send('root', 'streamClose', {
+                        stream: self.id,
+                        offset: self.written
+                    });
+                }
+                next();
+            });
+        });
+        return this.last;
+    };
+
+/**
+ * StreamWriter.abort
+ * Abort the stream, telling the server why.
+ * @param {String} reason
+ */
+    StreamWriter.prototype.abort = function abort(reason) {
+        var error = {
+            code: 'streamAborted',
+            message: reason || 'Stream aborted.'
+        };
+
+        this.socket.send('root', 'streamClose', {
+            stream: this.id,
+            offset: this.written,
+            error: error
+        });
+        this.fail(error);
+    };
+
+/**
+ * StreamWriter.flush
+ * Internal method sending the bytes written but not yet sent.
+ */
+    StreamWriter.prototype.flush = function flush() {
+        var size,
+            start;
+
+        while (this.sent < this.written) {
+            size = Math.min(this.chunk, this.written - this.sent);
+            start = this.sent - this.acked;
+            this.socket.send('root', 'streamChunk', {
+                stream: this.id,
+                offset: this.sent
+            }, this.buffer.slice(start, start + size));
+            this.sent += size;
+        }
+    };
+
+/**
+ * StreamWriter.wake
+ * Internal method resuming the writes and close waiting for an acknowledgement.
+ */
+    StreamWriter.prototype.wake = function wake() {
+        var waiting = this.waiting;
+
+        this.waiting = [];
+        waiting.forEach(function (next) {
+            next();
+        });
+    };
+
+/**
+ * StreamWriter.ack
+ * Internal method recording the bytes acknowledged by the server,
+ * and the window and chunk size it gives when accepting the stream.
+ * @param {Object} payload
+ */
+    StreamWriter.prototype.ack = function ack(payload) {
+        if (payload.offset < this.acked || payload.offset > this.sent) {
+            return;
+        }
+        if (payload.window) {
+            this.window = payload.window;
+            this.chunk = payload.chunk || this.chunk;
+        }
+        this.buffer = this.buffer.slice(payload.offset - this.acked);
+        this.acked = payload.offset;
+        this.wake();
+    };
+
+/**
+ * StreamWriter.resume
+ * Internal method sending the stream again from offset.
+ * @param {Number} offset
+ */
+    StreamWriter.prototype.resume = function resume(offset) {
+        if (offset < this.acked || offset > this.sent) {
+            return this.abort('Cannot resume the stream at this offset.');
+        }
+        this.sent = offset;
+        this.flush();
+    };
+
+/**
+ * StreamWriter.fail
+ * Internal method aborting the stream with error.
+ * @param {Object} error
+ */
+    StreamWriter.prototype.fail = function fail(error) {
+        if (!this.error) {
+            this.error = error;
+        }
+        delete this.socket.writers[this.id];
+        this.wake();
+    };
+
+/**
+ * StreamReader
+ * Reads a stream announced by the server with Conn.OpenStream.
+ * Emits 'data' with every chunk as a Uint8Array, then 'end',
+ * or 'error' if the stream is aborted.
+ * @param {WSRooms} socket
+ * @param {Object} payload
+ */
+    function StreamReader(socket, payload) {
+        eventEmitter(this);
+        this.socket = socket;
+        this.id = payload.stream;
+        this.event = payload.event;
+        this.meta = payload.meta === undefined ? null : payload.meta;
+        this.size = payload.size || 0;
+        this.received = 0;
+        this.acked = 0;
+        this.window = 1048576;
+        this.end = -1;
+        this.resuming = false;
+    }
+
+/**
+ * StreamReader.abort
+ * Abort the stream, telling the server why.
+ * @param {String} reason
+ */
+    StreamReader.prototype.abort = function abort(reason) {
+        delete this.socket.readers[this.id];
+        this.socket.send('root', 'streamClose', {
+            stream: this.id,
+            offset: this.received,
+            error: {
+                code: 'streamAborted',
+                message: reason || 'Stream aborted.'
+            }
+        });
+    };
+
+/**
+ * StreamReader.ack
+ * Internal method acknowledging the bytes received.
+ */
+    StreamReader.prototype.ack = function ack() {
+        this.acked = this.received;
+        this.socket.send('root', 'streamAck', {
+            stream: this.id,
+            offset: this.received
+        });
+    };
+
+/**
+ * StreamReader.resume
+ * Internal method asking the server to send the stream again from the bytes received.
+ */
+    StreamReader.prototype.resume = function resume() {
+        if (!this.resuming) {
+            this.resuming = true;
+            this.socket.send('root', 'streamResume', {
+                stream: this.id,
+                offset: this.received
+            });
+        }
+    };
+
+/**
+ * StreamReader.finish
+ * Internal method ending the stream once every byte was received.
+ */
+    StreamReader.prototype.finish = function finish() {
+        if (this.end < 0 || this.received !== this.end) {
+            return;
+        }
+        if (this.acked < this.end) {
+            this.ack();
+        }
+        delete this.socket.readers[this.id];
+        this.emit('end');
+    };
+
+/**
+ * StreamReader.push
+ * Internal method handling a chunk received at offset.
+ * @param {Number} offset
+ * @param {Uint8Array} data
+ */
+    StreamReader.prototype.push = function push(offset, data) {
+        if (offset !== this.received) {
+            return this.resume();
+        }
+        this.resuming = false;
+        this.received += data.length;
+        this.emit('data', data);
+        if (this.received - this.acked >= this.window / 2) {
+            this.ack();
+        }
+        this.finish();
+    };
+
+/**
+ * StreamReader.close
+ * Internal method handling the end of the stream at offset.
+ * @param {Number} offset
+ */
+    StreamReader.prototype.close = function close(offset) {
+        this.end = offset;
+        if (this.received < offset) {
+            return this.resume();
+        }
+        this.finish();
+    };
+
+/**
+ * WSRooms.stream
+ * Send a stream of bytes to the handler registered on the server for event with app.HandleStream.
+ * Returns a writer with the methods 'write', 'close' and 'abort'.
+ * @param {String} event
+ * @param {String || Array || Object || Boolean || Number || null} meta
+ * @param {Number} size total number of bytes, if known
+ * @return {Object} writer
+ */
+    WSRooms.prototype.stream = function stream(event, meta, size) {
+        var writer = new StreamWriter(this, 'c' + String(this.nextId++));
+
+        if (!this.open || typeof event !== 'string') {
+            writer.fail(new Error('Cannot open the stream.'));
+            return writer;
+        }
+        this.writers[writer.id] = writer;
+        this.send('root', 'streamOpen', {
+            stream: writer.id,
+            event: event,
+            meta: meta === undefined ? null : meta,
+            size: size || 0,
+            offset: 0
+        });
+        return writer;
+    };
+
+/**
+ * WSRooms.handleStream
+ * Internal method handling the messages of the streaming protocol.
+ * Streams announced by the server are emitted as a StreamReader under their event.
+ * @param {String} event
+ * @param {Object} payload
+ * @param {Uint8Array} data
+ */
+    WSRooms.prototype.handleStream = function handleStream(event, payload, data) {
+        var reader,
+            writer;
+
+        if (!payload || typeof payload.stream !== 'string') {
+            return;
+        }
+        reader = this.readers[payload.stream];
+        writer = this.writers[payload.stream];
+        switch (event) {
+            case 'streamOpen':
+                reader = new StreamReader(this, payload);
+                this.readers[reader.id] = reader;
+                this.send('root', 'streamAck', {
+                    stream: reader.id,
+                    offset: 0,
+                    window: reader.window
+                });
+                this.emit(reader.event, reader);
+                break;
+            case 'streamChunk':
+                if (reader) {
+                    reader.push(payload.offset, data || new Uint8Array(0));
+                }
+                break;
+            case 'streamAck':
+                if (writer) {
+                    writer.ack(payload);
+                }
+                break;
+            case 'streamResume':
+                if (writer) {
+                    writer.resume(payload.offset);
+                }
+                break;
+            case 'streamClose':
+                if (reader && payload.error) {
+                    delete this.readers[reader.id];
+                    reader.emit('error', payload.error);
+                } else if (reader) {
+                    reader.close(payload.offset);
+                } else if (writer) {
+                    writer.fail(payload.error || new Error('Stream closed.'));
+                }
+                break;
         }
-        data.payload = payload;
-        this.socket.send(JSON.stringify(data));
     };
 
 /**
  * WSRooms.handleMessage
  * Internal method used to handle the contents of a message after it has been received.
+ * Listeners of other events receive the payload and the binary attachment, if any.
  * @param {String} room
  * @param {String} event
  * @param {String || Array || Object || Boolean || Number || null} payload
+ * @param {Uint8Array} data
  */
-    WSRooms.prototype.handleMessage = function handleMessage(room, event, payload) {
-        var roomObj = this,
-            index;
+    WSRooms.prototype.handleMessage = function handleMessage(room, event, payload, data) {
+        var roomObj = this;
 
         if (!event || typeof event !== 'string' || !room || typeof room !== 'string' || typeof payload === undefined) {
             return;
@@ -90,49 +1165,125 @@
             roomObj = this.rooms[room];
         }
         switch (event) {
+            case 'resume':
+                if (room === 'root' && payload) {
+                    this.handleResume(payload);
+                }
+                break;
             case 'join':
                 roomObj.id = payload;
                 roomObj.open = true;
-                roomObj.emit('open');
-                if (room === 'root') {
-                    roomObj.send('root', 'joined', payload);
+                if (room === 'root' && this.reconnecting) {
+                    this.rejoin();
                 } else {
-                    roomObj.send('joined', payload);
-                }
-                break;
-            case 'joined':
-                index = roomObj.members.indexOf(payload);
-                if (roomObj.id !== payload && index === -1) {
-                    roomObj.members.push(payload);
-                    roomObj.emit('joined', payload)
+                    roomObj.emit('open');
                 }
                 break;
             case 'leave':
                 if (room === 'root') {
-                    roomObj.socket.close();
+                    this.closed = true;
+                    this.socket.close(1000);
                 } else {
                     roomObj.open = false;
                     roomObj.emit('close');
                     delete this.rooms[room];
                 }
-                roomObj.send(roomObj.room, 'left', roomObj.id);
                 break;
-            case 'left':
-                index = roomObj.members.indexOf(payload);
-                if (roomObj.id !== payload && index !== -1) {
-                    roomObj.members.splice(index, 1);
-                    roomObj.emit('left', payload);
+            case 'joinDenied':
+                if (room !== 'root') {
+                    delete this.rooms[room];
+                    roomObj.emit('denied', payload);
+                }
+                break;
+            case 'members':
+                if (room !== 'root' && Array.isArray(payload)) {
+                    roomObj.members = payload;
+                    roomObj.emit('members', payload);
+                }
+                break;
+            case 'presence':
+                if (room !== 'root' && payload && payload.member) {
+                    this.handlePresence(roomObj, payload.action, payload.member);
+                }
+                break;
+            case 'streamOpen':
+            case 'streamChunk':
+            case 'streamAck':
+            case 'streamClose':
+            case 'streamResume':
+                if (room === 'root') {
+                    this.handleStream(event, payload, data);
                 }
                 break;
             default:
-                roomObj.emit(event, payload);
+                roomObj.emit(event, payload, data);
                 break;
         }
     };
 
+/**
+ * WSRooms.handleResume
+ * Internal method keeping the resume token sent by the server.
+ * When the previous connection was resumed, its rooms are open again and
+ * 'reconnect' is emitted with true; otherwise the server opens a new
+ * connection and the rooms are joined again once root is, see WSRooms.rejoin.
+ * @param {Object} payload {id, token, resumed}
+ */
+    WSRooms.prototype.handleResume = function handleResume(payload) {
+        this.token = payload.token || null;
+        if (!this.reconnecting || !payload.resumed) {
+            return;
+        }
+        this.reconnecting = false;
+        this.retries = 0;
+        this.open = true;
+        Object.keys(this.rooms).forEach(function (room) {
+            this.rooms[room].open = true;
+        }, this);
+        this.emit('reconnect', true);
+    };
+
+/**
+ * WSRooms.rejoin
+ * Internal method joining the rooms of a connection that could not be
+ * resumed again, with their password and the sequence number of the last
+ * message received, so that the messages missed meanwhile are received
+ * from the rooms that keep a history. Emits 'reconnect' with false.
+ */
+    WSRooms.prototype.rejoin = function rejoin() {
+        this.reconnecting = false;
+        this.retries = 0;
+        Object.keys(this.rooms).forEach(function (room) {
+            this.sendJoin(this.rooms[room]);
+        }, this);
+        this.emit('reconnect', false);
+    };
+
+/**
+ * WSRooms.handlePresence
+ * Internal method updating the members of a room after a presence event,
+ * and emitting 'joined', 'left' or 'state' with the member.
+ * @param {Object} roomObj
+ * @param {String} action 'join', 'leave' or 'state'
+ * @param {Object} member
+ */
+    WSRooms.prototype.handlePresence = function handlePresence(roomObj, action, member) {
+        var members = roomObj.members.filter(function (m) {
+            return m.id !== member.id;
+        });
+
+        if (action !== 'leave') {
+            members.push(member);
+        }
+        roomObj.members = members;
+        if (member.id !== roomObj.id) {
+            roomObj.emit(action === 'join' ? 'joined' : action === 'leave' ? 'left' : 'state', member);
+        }
+    };
+
 /**
  * WSRooms.onmessage
- * Called when a message is received.
+ * Called when a message is received; text and binary frames are decoded with the socket's codec.
  * @param {Event} e
  */
     WSRooms.prototype.onmessage = function onmessage(e) {
@@ -142,49 +1293,89 @@
             payload;
 
         try {
-            data = JSON.parse(data);
+            data = this.codec().decode(data);
         } catch (ignore) {
-            return console.log("Invalid message format: Not JSON");
+            return console.log("Invalid message format: " + ignore.message);
         }
-        if (typeof data.payload !== undefined) {
-            try {
-                payload = JSON.parse(data.payload);
-            } catch (ignore) {
-                payload = data.payload;    
-            }
-        } else {
-            payload = null;
+        if (!data || typeof data !== 'object') {
+            return console.log("Invalid message format: Not an object");
         }
+        payload = data.payload === undefined ? null : data.payload;
         event = data.event;
         room = data.room;
-        this.handleMessage(room, event, payload);
+        if (data.id && this.handleReply(data.id, event, payload)) {
+            return;
+        }
+        if (data.seq && this.rooms.hasOwnProperty(room) && data.seq > this.rooms[room].seq) {
+            this.rooms[room].seq = data.seq;
+        }
+        this.handleMessage(room, event, payload, data.data || null);
     };
 
 /**
  * WSRooms.join
- * Join a room. Returns an eventEmitter object with the methods 'send' and 'leave'.
+ * Join a room. Returns an eventEmitter object with the methods 'send', 'call',
+ * 'setState', 'listMembers' and 'leave'.
+ * A password is sent to rooms requiring one. If the server refuses the join,
+ * the object emits 'denied' with the error.
+ * If since is given, the messages kept in the room's history after that
+ * sequence number are received first; the object's seq holds the sequence
+ * number of the last message received.
+ * Its members are the objects {id, username, privilege, state} kept up to date
+ * by the server, which emits 'joined', 'left' and 'state' with the member
+ * that changed.
  * @param {String} room
+ * @param {String} password optional
+ * @param {Number} since optional
  * @return {Object} sock
  */
-    WSRooms.prototype.join = function join(room) {
-        var sock = {};
+    WSRooms.prototype.join = function join(room, password, since) {
+        var sock = {},
+            payload = null;
 
         if (!this.open || !room || typeof room !== 'string' || this.rooms.hasOwnProperty(room)) {
             return;
         }
         eventEmitter(sock);
         sock.id = null;
+        sock.seq = since || 0;
         sock.members = [];
         sock.open = false;
         sock.room = room;
         sock.send = this.send.bind(this, room);
+        sock.call = this.call.bind(this, room);
+        sock.setState = this.send.bind(this, room, 'setState');
+        sock.listMembers = this.call.bind(this, room, 'listMembers', null);
         sock.leave = this.leave.bind(this, room);
         sock.close = sock.leave;
+        sock.password = password || null;
         this.rooms[room] = sock;
-        this.send(room, 'join', null);
+        this.sendJoin(sock, typeof since === 'number');
         return sock;
     };
 
+/**
+ * WSRooms.sendJoin
+ * Internal method asking the server to join a room, with its password
+ * and, if replay is set or messages were received, its sequence number.
+ * @param {Object} sock
+ * @param {Boolean} replay
+ */
+    WSRooms.prototype.sendJoin = function sendJoin(sock, replay) {
+        var payload = null;
+
+        if (sock.password || replay || sock.seq > 0) {
+            payload = {};
+            if (sock.password) {
+                payload.password = sock.password;
+            }
+            if (replay || sock.seq > 0) {
+                payload.since = sock.seq;
+            }
+        }
+        this.send(sock.room, 'join', payload);
+    };
+
 /**
  * WSRooms.leave / WSRooms.close
  * Leave a room.
@@ -198,8 +1389,33 @@
 /**
  * WSRooms.close
  * Called when an instance of WSRooms is closed.
+ * Pending calls and streams fail. Unless root was left or reconnect is false,
+ * 'disconnect' is emitted, the rooms are kept and the socket is reconnected
+ * after a delay doubling with every attempt; the server resumes the
+ * connection if it is still within its grace period.
  */
     WSRooms.prototype.onclose = function onclose() {
+        Object.keys(this.calls).forEach(function (id) {
+            this.calls[id].reject(new Error('Socket closed.'));
+            delete this.calls[id];
+        }, this);
+        Object.keys(this.readers).forEach(function (id) {
+            this.readers[id].emit('error', new Error('Socket closed.'));
+            delete this.readers[id];
+        }, this);
+        Object.keys(this.writers).forEach(function (id) {
+            this.writers[id].fail(new Error('Socket closed.'));
+        }, this);
+        this.open = false;
+        if (!this.closed && this.reconnect) {
+            Object.keys(this.rooms).forEach(function (room) {
+                this.rooms[room].open = false;
+            }, this);
+            this.reconnecting = true;
+            this.emit('disconnect');
+            setTimeout(this.connect.bind(this), this.backoff());
+            return;
+        }
         Object.keys(this.rooms).forEach(function (room) {
             this.rooms[room].emit('close');
             delete this.rooms[room];
@@ -208,6 +1424,20 @@
         this.emit('close');
     };
 
+/**
+ * WSRooms.backoff
+ * Internal method returning the delay before the next reconnection attempt:
+ * between half and all of 500 milliseconds doubled with every attempt,
+ * up to maxDelay.
+ * @return {Number} delay
+ */
+    WSRooms.prototype.backoff = function backoff() {
+        var delay = Math.min(this.maxDelay, 500 * Math.pow(2, this.retries));
+
+        this.retries += 1;
+        return delay / 2 + Math.random() * delay / 2;
+    };
+
 /**
  * WSRooms.onerror
  * Called when an error occurs on an instance of WSRooms.
@@ -217,8 +1447,8 @@
         this.emit('error', e);
     };
 
-    global.wsrooms = function wsrooms(url) {
-        return new WSRooms(url);
+    global.wsrooms = function wsrooms(url, protocol) {
+        return new WSRooms(url, protocol);
     };
 
 }(this || window));
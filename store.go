@@ -0,0 +1,102 @@
+//    Title: store.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Store is the interface implemented by a storage backend.
+// Every entry in the database block of config.json is backed by a Store
+// created by the factory registered under the entry's name.
+type Store interface {
+	// Start connects to the backend and makes sure every table in tables exists.
+	Start(tables []string) error
+	// Stop flushes any pending state and releases the backend's resources.
+	Stop() error
+	// GetObj returns the object stored in table under key.
+	// Missing keys are reported with ErrObjectNotFound, as by UpdateObj
+	// and DeleteObj, and keys already in use by InsertObj with
+	// ErrObjectExists.
+	GetObj(table string, key string) (interface{}, error)
+	// GetAllObjs returns every object in table as a map with
+	// "hash" and "data" fields.
+	GetAllObjs(table string) ([]interface{}, error)
+	// InsertObj stores data in table under key.
+	// It fails if key is already in use.
+	InsertObj(table string, key string, data interface{}) error
+	// UpdateObj replaces the object stored in table under key with data.
+	// It fails if key is not in use.
+	UpdateObj(table string, key string, data interface{}) error
+	// UpsertObj stores data in table under key, replacing any existing object.
+	UpsertObj(table string, key string, data interface{}) error
+	// QueryObjs returns the objects in table matching q, in the same form
+	// as GetAllObjs. Stores without a native query language may implement
+	// it with FilterObjs.
+	QueryObjs(table string, q *Query) ([]interface{}, error)
+	// DeleteObj removes the object stored in table under key.
+	// It fails if key is not in use.
+	DeleteObj(table string, key string) error
+}
+
+// StoreFactory creates a Store from the parameters given in config.json.
+type StoreFactory func(params map[string]string) (Store, error)
+
+var (
+	storesMu sync.RWMutex
+	stores   = make(map[string]StoreFactory)
+)
+
+// RegisterStore makes a storage backend available under name.
+// It panics if factory is nil or if RegisterStore is called twice with the same name.
+func RegisterStore(name string, factory StoreFactory) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if factory == nil {
+		panic("rtgo: RegisterStore factory is nil")
+	}
+	if _, dup := stores[name]; dup {
+		panic("rtgo: RegisterStore called twice for store " + name)
+	}
+	stores[name] = factory
+}
+
+// Stores returns a sorted list of the names of the registered stores.
+func Stores() []string {
+	storesMu.RLock()
+	defer storesMu.RUnlock()
+	list := make([]string, 0, len(stores))
+	for name := range stores {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// OpenStore creates a new Store using the factory registered under name.
+// It returns the new store or an error.
+func OpenStore(name string, params map[string]string) (Store, error) {
+	storesMu.RLock()
+	factory, ok := stores[name]
+	storesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Store %s is not registered.", name)
+	}
+	return factory(params)
+}
@@ -0,0 +1,255 @@
+//    Title: store_memory.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+func init() {
+	RegisterStore("memory", newMemoryStore)
+}
+
+// MemoryStore is a Store that keeps every table in process memory.
+// Objects are held JSON encoded so callers never share state with the store.
+// If a snapshot file is configured, the tables are loaded from it on Start
+// and written back to it on Stop.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	file   string
+	tables map[string]map[string][]byte
+}
+
+// newMemoryStore creates a MemoryStore snapshotting to params["file"], if set.
+func newMemoryStore(params map[string]string) (Store, error) {
+	return NewMemoryStore(params["file"]), nil
+}
+
+// NewMemoryStore creates a MemoryStore.
+// If file is not empty, the store is loaded from and snapshotted to it.
+// It returns the new store.
+func NewMemoryStore(file string) *MemoryStore {
+	return &MemoryStore{
+		file:   file,
+		tables: make(map[string]map[string][]byte),
+	}
+}
+
+// Start loads the snapshot file, if any, and creates any missing tables.
+func (s *MemoryStore) Start(tables []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != "" {
+		if err := s.load(); err != nil {
+			return err
+		}
+	}
+	for _, table := range tables {
+		if _, exists := s.tables[table]; !exists {
+			s.tables[table] = make(map[string][]byte)
+		}
+	}
+	return nil
+}
+
+// Stop writes the snapshot file, if any.
+func (s *MemoryStore) Stop() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.file == "" {
+		return nil
+	}
+	return s.save()
+}
+
+// load reads the tables from the snapshot file.
+// A missing snapshot file is not an error.
+func (s *MemoryStore) load() error {
+	file, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	snapshot := make(map[string]map[string]json.RawMessage)
+	if err := json.Unmarshal(file, &snapshot); err != nil {
+		return err
+	}
+	for table, objs := range snapshot {
+		s.tables[table] = make(map[string][]byte)
+		for key, blob := range objs {
+			s.tables[table][key] = []byte(blob)
+		}
+	}
+	return nil
+}
+
+// save writes the tables to the snapshot file.
+// The file is replaced atomically so a crash never leaves a partial snapshot.
+func (s *MemoryStore) save() error {
+	snapshot := make(map[string]map[string]json.RawMessage)
+	for table, objs := range s.tables {
+		snapshot[table] = make(map[string]json.RawMessage)
+		for key, blob := range objs {
+			snapshot[table][key] = json.RawMessage(blob)
+		}
+	}
+	file, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, file, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// GetAllObjs gets every object in a table, ordered by key.
+// It returns an array of interfaces or an error.
+func (s *MemoryStore) GetAllObjs(table string) ([]interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	objs, exists := s.tables[table]
+	if !exists {
+		return nil, ErrTableNotFound
+	}
+	keys := make([]string, 0, len(objs))
+	for key := range objs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		var value interface{}
+		if err := json.Unmarshal(objs[key], &value); err != nil {
+			return nil, err
+		}
+		data = append(data, map[string]interface{}{
+			"hash": key,
+			"data": value,
+		})
+	}
+	return data, nil
+}
+
+// GetObj gets the object in a table with the matching key.
+// It returns an interface or an error.
+func (s *MemoryStore) GetObj(table string, key string) (interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var data interface{}
+	if _, exists := s.tables[table]; !exists {
+		return nil, ErrTableNotFound
+	}
+	blob, exists := s.tables[table][key]
+	if !exists {
+		return nil, ErrObjectNotFound
+	}
+	if err := json.Unmarshal(blob, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// DeleteObj deletes the object in a table with a matching key.
+// It may return an error.
+func (s *MemoryStore) DeleteObj(table string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.tables[table]; !exists {
+		return ErrTableNotFound
+	}
+	if _, exists := s.tables[table][key]; !exists {
+		return ErrObjectNotFound
+	}
+	delete(s.tables[table], key)
+	return nil
+}
+
+// InsertObj stores data in a table with the specified key.
+// Like the SQL stores, it fails if the key is already in use.
+// It may return an error.
+func (s *MemoryStore) InsertObj(table string, key string, data interface{}) error {
+	blob, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.tables[table]; !exists {
+		return ErrTableNotFound
+	}
+	if _, exists := s.tables[table][key]; exists {
+		return ErrObjectExists
+	}
+	s.tables[table][key] = blob
+	return nil
+}
+
+// UpdateObj replaces the object in a table with the specified key.
+// It returns an error if no such object exists.
+func (s *MemoryStore) UpdateObj(table string, key string, data interface{}) error {
+	blob, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.tables[table]; !exists {
+		return ErrTableNotFound
+	}
+	if _, exists := s.tables[table][key]; !exists {
+		return ErrObjectNotFound
+	}
+	s.tables[table][key] = blob
+	return nil
+}
+
+// UpsertObj stores data in a table with the specified key,
+// replacing any existing object.
+// It may return an error.
+func (s *MemoryStore) UpsertObj(table string, key string, data interface{}) error {
+	blob, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.tables[table]; !exists {
+		return ErrTableNotFound
+	}
+	s.tables[table][key] = blob
+	return nil
+}
+
+// QueryObjs filters, sorts and paginates the objects in a table in memory.
+// It returns an array of interfaces or an error.
+func (s *MemoryStore) QueryObjs(table string, q *Query) ([]interface{}, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	objs, err := s.GetAllObjs(table)
+	if err != nil {
+		return nil, err
+	}
+	return FilterObjs(objs, q), nil
+}
@@ -0,0 +1,185 @@
+//    Title: store_riak.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tpjg/goriakpbc"
+)
+
+func init() {
+	RegisterStore("riak", newRiakStore)
+}
+
+// RiakStore is a Store backed by Riak buckets.
+type RiakStore struct {
+	dsn     string
+	buckets map[string]*riak.Bucket
+}
+
+// newRiakStore creates a RiakStore connecting to params["host"]:params["port"].
+func newRiakStore(params map[string]string) (Store, error) {
+	s := &RiakStore{
+		dsn:     fmt.Sprintf("%s:%s", params["host"], params["port"]),
+		buckets: make(map[string]*riak.Bucket),
+	}
+	return s, nil
+}
+
+// Start connects to Riak and opens a bucket for every table.
+func (s *RiakStore) Start(tables []string) error {
+	if err := riak.ConnectClient(s.dsn); err != nil {
+		return errors.New("Cannot connect, is Riak running?")
+	}
+	for _, bname := range tables {
+		bucket, err := riak.NewBucket(bname)
+		if err != nil {
+			return err
+		}
+		s.buckets[bname] = bucket
+	}
+	return nil
+}
+
+// Stop is a no-op; the Riak client is shared by every RiakStore.
+func (s *RiakStore) Stop() error {
+	return nil
+}
+
+// GetAllObjs gets every object in a bucket.
+// It returns an array of interfaces or an error.
+func (s *RiakStore) GetAllObjs(table string) ([]interface{}, error) {
+	data := make([]interface{}, 0)
+	if _, exists := s.buckets[table]; !exists {
+		return nil, ErrTableNotFound
+	}
+	keys, err := s.buckets[table].ListKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		collect := make(map[string]interface{})
+		obj, err := s.GetObj(table, string(key))
+		if err != nil {
+			return nil, err
+		}
+		collect["hash"] = string(key)
+		collect["data"] = obj
+		data = append(data, collect)
+	}
+	return data, nil
+}
+
+// GetObj gets the object in a bucket with the matching key.
+// It returns an interface or an error.
+func (s *RiakStore) GetObj(table string, key string) (interface{}, error) {
+	var data interface{}
+	if _, exists := s.buckets[table]; !exists {
+		return nil, ErrTableNotFound
+	}
+	if exists, _ := s.buckets[table].Exists(key); !exists {
+		return nil, ErrObjectNotFound
+	}
+	obj, err := s.buckets[table].Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(obj.Data, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// DeleteObj deletes the object in a bucket with a matching key.
+// It may return an error.
+func (s *RiakStore) DeleteObj(table string, key string) error {
+	if _, exists := s.buckets[table]; !exists {
+		return ErrTableNotFound
+	}
+	if exists, err := s.buckets[table].Exists(key); err != nil {
+		return err
+	} else if !exists {
+		return ErrObjectNotFound
+	}
+	return s.buckets[table].Delete(key)
+}
+
+// InsertObj stores data in a bucket with the specified key.
+// Like the SQL stores, it fails if the key is already in use.
+// It may return an error.
+func (s *RiakStore) InsertObj(table string, key string, data interface{}) error {
+	if _, exists := s.buckets[table]; !exists {
+		return ErrTableNotFound
+	}
+	if exists, err := s.buckets[table].Exists(key); err != nil {
+		return err
+	} else if exists {
+		return ErrObjectExists
+	}
+	return s.store(table, key, data)
+}
+
+// UpdateObj replaces the object in a bucket with the specified key.
+// It returns an error if no such object exists.
+func (s *RiakStore) UpdateObj(table string, key string, data interface{}) error {
+	if _, exists := s.buckets[table]; !exists {
+		return ErrTableNotFound
+	}
+	if exists, err := s.buckets[table].Exists(key); err != nil {
+		return err
+	} else if !exists {
+		return ErrObjectNotFound
+	}
+	return s.store(table, key, data)
+}
+
+// UpsertObj stores data in a bucket with the specified key,
+// replacing any existing object.
+// It may return an error.
+func (s *RiakStore) UpsertObj(table string, key string, data interface{}) error {
+	if _, exists := s.buckets[table]; !exists {
+		return ErrTableNotFound
+	}
+	return s.store(table, key, data)
+}
+
+// store writes data to a bucket with the specified key.
+func (s *RiakStore) store(table string, key string, data interface{}) error {
+	blob, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	obj := s.buckets[table].NewObject(key)
+	obj.ContentType = "application/json"
+	obj.Data = blob
+	return obj.Store()
+}
+
+// QueryObjs filters, sorts and paginates the objects in a bucket in memory.
+// It returns an array of interfaces or an error.
+func (s *RiakStore) QueryObjs(table string, q *Query) ([]interface{}, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	objs, err := s.GetAllObjs(table)
+	if err != nil {
+		return nil, err
+	}
+	return FilterObjs(objs, q), nil
+}
@@ -0,0 +1,431 @@
+//    Title: store_sql.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterStore("postgres", newPostgresStore)
+	RegisterStore("mysql", newMySQLStore)
+	RegisterStore("sqlite3", newSQLiteStore)
+}
+
+// tableregex matches the table names SQLStore accepts, which are placed
+// in its statements as they are.
+var tableregex = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// checkTable checks that a table name is a plain identifier.
+// It returns an error otherwise.
+func checkTable(table string) error {
+	if !tableregex.MatchString(table) {
+		return fmt.Errorf("Invalid table name %q.", table)
+	}
+	return nil
+}
+
+// SQLStore is a Store backed by a database/sql driver.
+// Every table has a (hash, data) layout where data holds the JSON encoded object.
+type SQLStore struct {
+	driver     string
+	dsn        string
+	create     string
+	upsert     string
+	connection *sql.DB
+}
+
+// newPostgresStore creates a SQLStore using the lib/pq driver.
+func newPostgresStore(params map[string]string) (Store, error) {
+	s := &SQLStore{
+		driver: "postgres",
+		dsn:    fmt.Sprintf("dbname=%s user=%s password=%s host=%s sslmode=%s fallback_application_name=%s connect_timeout=%s sslcert=%s sslkey=%s sslrootcert=%s", params["dbname"], params["user"], params["password"], params["host"], params["sslmode"], params["fallback_application_name"], params["connect_timeout"], params["sslcert"], params["sslkey"], params["sslrootcert"]),
+		create: "CREATE TABLE IF NOT EXISTS %s (hash VARCHAR(255) NOT NULL UNIQUE PRIMARY KEY, data BYTEA)",
+		upsert: "INSERT INTO %s (hash, data) VALUES (?, ?) ON CONFLICT (hash) DO UPDATE SET data = EXCLUDED.data",
+	}
+	return s, nil
+}
+
+// newMySQLStore creates a SQLStore using the go-sql-driver/mysql driver.
+func newMySQLStore(params map[string]string) (Store, error) {
+	s := &SQLStore{
+		driver: "mysql",
+		dsn:    fmt.Sprintf("%s:%s@%s/%s?allowAllFiles=%s&allowOldPasswords=%s&charset=%s&collation=%s&clientFoundRows=%s&loc=%s&parseTime=%s&strict=%s&timeout=%s&tls=%s", params["user"], params["password"], params["host"], params["dbname"], params["allowAllFiles"], params["allowOldPasswords"], params["charset"], params["collation"], params["clientFoundRows"], params["loc"], params["parseTime"], params["strict"], params["timeout"], params["tls"]),
+		create: "CREATE TABLE IF NOT EXISTS %s (hash VARCHAR(255) NOT NULL UNIQUE PRIMARY KEY, data LONGBLOB)",
+		upsert: "INSERT INTO %s (hash, data) VALUES (?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data)",
+	}
+	return s, nil
+}
+
+// newSQLiteStore creates a SQLStore using the mattn/go-sqlite3 driver.
+func newSQLiteStore(params map[string]string) (Store, error) {
+	s := &SQLStore{
+		driver: "sqlite3",
+		dsn:    params["file"],
+		create: "CREATE TABLE IF NOT EXISTS %s (hash VARCHAR(255) NOT NULL UNIQUE PRIMARY KEY, data BLOB)",
+		upsert: "INSERT OR REPLACE INTO %s (hash, data) VALUES (?, ?)",
+	}
+	return s, nil
+}
+
+// DB returns the open database handle.
+func (s *SQLStore) DB() *sql.DB {
+	return s.connection
+}
+
+// Dialect returns the name of the database/sql driver.
+func (s *SQLStore) Dialect() string {
+	return s.driver
+}
+
+// bind rewrites the ? placeholders in query into the placeholder
+// style of the store's driver.
+func (s *SQLStore) bind(query string) string {
+	return rebind(s.driver, query)
+}
+
+// rebind rewrites the ? placeholders in query into the placeholder
+// style of driver.
+func rebind(driver string, query string) string {
+	if driver != "postgres" {
+		return query
+	}
+	var buf strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			buf.WriteRune(r)
+			continue
+		}
+		n++
+		fmt.Fprintf(&buf, "$%d", n)
+	}
+	return buf.String()
+}
+
+// Start opens the connection and creates any missing tables.
+func (s *SQLStore) Start(tables []string) error {
+	dbconn, err := sql.Open(s.driver, s.dsn)
+	if err != nil {
+		return err
+	}
+	s.connection = dbconn
+	for _, table := range tables {
+		if err := checkTable(table); err != nil {
+			return err
+		}
+		statement := fmt.Sprintf(s.create, table)
+		if _, err := s.connection.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop closes the connection.
+func (s *SQLStore) Stop() error {
+	if s.connection == nil {
+		return nil
+	}
+	return s.connection.Close()
+}
+
+// GetAllObjs selects the hash and data of every row in a database table,
+// leaving out any column added by migrations.
+// It returns an array of interfaces or an error.
+func (s *SQLStore) GetAllObjs(table string) ([]interface{}, error) {
+	if err := checkTable(table); err != nil {
+		return nil, err
+	}
+	data := make([]interface{}, 0)
+	query := fmt.Sprintf("SELECT hash, data FROM %s", table)
+	rows, err := s.connection.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		var blob []byte
+		if err := rows.Scan(&hash, &blob); err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if err := json.Unmarshal(blob, &value); err != nil {
+			return nil, err
+		}
+		data = append(data, map[string]interface{}{
+			"hash": hash,
+			"data": value,
+		})
+	}
+	return data, rows.Err()
+}
+
+// GetObj selects data from a table with the matching key.
+// It returns an interface or an error.
+func (s *SQLStore) GetObj(table string, key string) (interface{}, error) {
+	if err := checkTable(table); err != nil {
+		return nil, err
+	}
+	var data interface{}
+	blob := make([]byte, 0)
+	query := s.bind(fmt.Sprintf("SELECT data FROM %s WHERE hash = ?", table))
+	if err := s.connection.QueryRow(query, key).Scan(&blob); err == sql.ErrNoRows {
+		return nil, ErrObjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(blob, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// DeleteObj deletes a row from a database table with a matching key.
+// It may return an error.
+func (s *SQLStore) DeleteObj(table string, key string) error {
+	if err := checkTable(table); err != nil {
+		return err
+	}
+	query := s.bind(fmt.Sprintf("DELETE FROM %s WHERE hash = ?", table))
+	result, err := s.connection.Exec(query, key)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrObjectNotFound
+	}
+	return nil
+}
+
+// InsertObj inserts data into a database table with the specified key.
+// It may return an error.
+func (s *SQLStore) InsertObj(table string, key string, data interface{}) error {
+	if err := checkTable(table); err != nil {
+		return err
+	}
+	blob, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	query := s.bind(fmt.Sprintf("INSERT INTO %s (hash, data) VALUES (?, ?)", table))
+	if _, err := s.connection.Exec(query, key, blob); err != nil {
+		// Drivers report duplicate keys in their own ways,
+		// so check whether the row exists.
+		if exists, cerr := s.exists(table, key); cerr == nil && exists {
+			return ErrObjectExists
+		}
+		return err
+	}
+	return nil
+}
+
+// UpdateObj replaces the data of the row in a database table with a matching key.
+// It returns an error if no such row exists.
+func (s *SQLStore) UpdateObj(table string, key string, data interface{}) error {
+	if err := checkTable(table); err != nil {
+		return err
+	}
+	blob, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	query := s.bind(fmt.Sprintf("UPDATE %s SET data = ? WHERE hash = ?", table))
+	result, err := s.connection.Exec(query, blob, key)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	// MySQL reports zero affected rows when the data is unchanged,
+	// so make sure the row is really missing.
+	exists, err := s.exists(table, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrObjectNotFound
+	}
+	return nil
+}
+
+// exists reports whether a row of a database table has the key.
+// It may return an error.
+func (s *SQLStore) exists(table string, key string) (bool, error) {
+	var count int
+	query := s.bind(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE hash = ?", table))
+	if err := s.connection.QueryRow(query, key).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// UpsertObj inserts data into a database table with the specified key,
+// replacing the data of any existing row.
+// It may return an error.
+func (s *SQLStore) UpsertObj(table string, key string, data interface{}) error {
+	if err := checkTable(table); err != nil {
+		return err
+	}
+	blob, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	query := s.bind(fmt.Sprintf(s.upsert, table))
+	if _, err := s.connection.Exec(query, key, blob); err != nil {
+		return err
+	}
+	return nil
+}
+
+// QueryObjs selects the rows in a database table matching q, filtering and
+// sorting on the JSON data column with the JSON functions of the store's dialect.
+// It returns an array of interfaces or an error.
+func (s *SQLStore) QueryObjs(table string, q *Query) ([]interface{}, error) {
+	if err := checkTable(table); err != nil {
+		return nil, err
+	}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	args := make([]interface{}, 0)
+	query := fmt.Sprintf("SELECT hash, data FROM %s", table)
+	if len(q.Filters) > 0 {
+		where := make([]string, 0, len(q.Filters))
+		for _, f := range q.Filters {
+			expr, arg := s.filter(f)
+			where = append(where, fmt.Sprintf("%s %s ?", expr, f.Op))
+			args = append(args, arg)
+		}
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if len(q.Sort) > 0 {
+		order := make([]string, 0, len(q.Sort))
+		for _, o := range q.Sort {
+			expr := s.field(o.Field)
+			if o.Desc {
+				expr += " DESC"
+			}
+			order = append(order, expr)
+		}
+		query += " ORDER BY " + strings.Join(order, ", ")
+	}
+	if q.Limit > 0 || q.Offset > 0 {
+		limit := int64(q.Limit)
+		if limit == 0 {
+			limit = math.MaxInt64
+		}
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, q.Offset)
+	}
+	rows, err := s.connection.Query(s.bind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	data := make([]interface{}, 0)
+	for rows.Next() {
+		var hash string
+		var blob []byte
+		var value interface{}
+		if err := rows.Scan(&hash, &blob); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(blob, &value); err != nil {
+			return nil, err
+		}
+		data = append(data, map[string]interface{}{
+			"hash": hash,
+			"data": value,
+		})
+	}
+	return data, rows.Err()
+}
+
+// field returns the expression selecting the JSON value at path
+// from the data column, suitable for sorting.
+func (s *SQLStore) field(path string) string {
+	switch s.driver {
+	case "postgres":
+		return fmt.Sprintf("(convert_from(data, 'UTF8')::jsonb #> '{%s}')", strings.Replace(path, ".", ",", -1))
+	case "mysql":
+		return fmt.Sprintf("JSON_EXTRACT(CONVERT(data USING utf8mb4), '$.%s')", path)
+	default:
+		return fmt.Sprintf("json_extract(CAST(data AS TEXT), '$.%s')", path)
+	}
+}
+
+// filter returns the expression selecting the JSON value at f.Field from
+// the data column, or NULL if it is not of the same type as f.Value,
+// along with the argument to compare it to.
+func (s *SQLStore) filter(f Filter) (string, interface{}) {
+	var kind string
+	var arg interface{}
+	switch v := f.Value.(type) {
+	case float64:
+		kind, arg = "number", v
+	case bool:
+		kind, arg = "boolean", strconv.FormatBool(v)
+	default:
+		kind, arg = "string", v
+	}
+	switch s.driver {
+	case "postgres":
+		doc := "convert_from(data, 'UTF8')::jsonb"
+		path := strings.Replace(f.Field, ".", ",", -1)
+		value := fmt.Sprintf("(%s #>> '{%s}')", doc, path)
+		if kind == "number" {
+			value += "::numeric"
+		}
+		return fmt.Sprintf("(CASE WHEN jsonb_typeof(%s #> '{%s}') = '%s' THEN %s END)", doc, path, kind, value), arg
+	case "mysql":
+		extract := fmt.Sprintf("JSON_EXTRACT(CONVERT(data USING utf8mb4), '$.%s')", f.Field)
+		types := map[string]string{
+			"number":  "'INTEGER', 'UNSIGNED INTEGER', 'DOUBLE', 'DECIMAL'",
+			"boolean": "'BOOLEAN'",
+			"string":  "'STRING'",
+		}
+		value := fmt.Sprintf("JSON_UNQUOTE(%s)", extract)
+		if kind == "number" {
+			value = fmt.Sprintf("(%s + 0)", extract)
+		}
+		return fmt.Sprintf("(CASE WHEN JSON_TYPE(%s) IN (%s) THEN %s END)", extract, types[kind], value), arg
+	default:
+		doc := "CAST(data AS TEXT)"
+		types := map[string]string{
+			"number":  "'integer', 'real'",
+			"boolean": "'true', 'false'",
+			"string":  "'text'",
+		}
+		value := fmt.Sprintf("json_extract(%s, '$.%s')", doc, f.Field)
+		if kind == "boolean" {
+			value = fmt.Sprintf("json_type(%s, '$.%s')", doc, f.Field)
+		}
+		return fmt.Sprintf("(CASE WHEN json_type(%s, '$.%s') IN (%s) THEN %s END)", doc, f.Field, types[kind], value), arg
+	}
+}
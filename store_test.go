@@ -0,0 +1,76 @@
+//    Title: store_test.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreObjectErrors(t *testing.T) {
+	stores := map[string]Store{
+		"memory": NewMemoryStore(""),
+	}
+	sqlite, err := newSQLiteStore(map[string]string{"file": filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores["sqlite3"] = sqlite
+	for name, store := range stores {
+		if err := store.Start([]string{"test"}); err != nil {
+			t.Fatal(name, err)
+		}
+		defer store.Stop()
+		if _, err := store.GetObj("test", "a"); err != ErrObjectNotFound {
+			t.Errorf("%s: GetObj on a missing key: %v", name, err)
+		}
+		if err := store.UpdateObj("test", "a", 1); err != ErrObjectNotFound {
+			t.Errorf("%s: UpdateObj on a missing key: %v", name, err)
+		}
+		if err := store.DeleteObj("test", "a"); err != ErrObjectNotFound {
+			t.Errorf("%s: DeleteObj on a missing key: %v", name, err)
+		}
+		if err := store.InsertObj("test", "a", 1); err != nil {
+			t.Fatal(name, err)
+		}
+		if err := store.InsertObj("test", "a", 2); err != ErrObjectExists {
+			t.Errorf("%s: InsertObj on a key in use: %v", name, err)
+		}
+		if err := store.DeleteObj("test", "a"); err != nil {
+			t.Errorf("%s: DeleteObj: %v", name, err)
+		}
+	}
+}
+
+func TestGetObjNotFound(t *testing.T) {
+	app := newTestApp(t, `, "roles": {"guest": ["getObj:*"]}`)
+	ws := dialTestApp(t, app)
+	readUntil(t, ws, "join")
+	payload, _ := json.Marshal(map[string]string{"db": "memory", "table": "test", "key": "missing"})
+	if err := ws.WriteJSON(&Message{Room: "root", Event: "getObj", ID: "1", Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	reply := readUntil(t, ws, "error")
+	var e Error
+	if err := json.Unmarshal(reply.Payload, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Code != ErrObjectNotFound.Code {
+		t.Errorf("got %s", reply.Payload)
+	}
+}
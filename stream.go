@@ -0,0 +1,557 @@
+//    Title: stream.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/pborman/uuid"
+)
+
+// Streams carry a sequence of bytes too large for a single message
+// between a connection and the server, in the root room:
+//   - the sender announces a stream with streamOpen, giving its id, the event
+//     of the handler it is meant for, optional metadata and its size, if known
+//   - the receiver accepts it with a streamAck at offset 0 giving its window,
+//     the number of bytes it buffers, and the largest chunk it accepts,
+//     or refuses it with a streamClose carrying an error
+//   - the sender sends streamChunk messages holding the offset of their first
+//     byte, with the bytes in the message data, and never sends more than
+//     window bytes past the last acknowledged offset
+//   - the receiver acknowledges the bytes it has consumed with streamAck, and
+//     asks the sender to go back to an offset with streamResume when a chunk
+//     does not start where the previous one ended
+//   - the sender ends the stream with a streamClose holding the final offset,
+//     and waits for it to be acknowledged; either side aborts the stream with
+//     a streamClose carrying an error.
+
+// StreamMessage is the payload of the streamOpen, streamChunk, streamAck,
+// streamClose and streamResume events.
+type StreamMessage struct {
+	Stream string          `json:"stream"`
+	Event  string          `json:"event,omitempty"`
+	Meta   json.RawMessage `json:"meta,omitempty"`
+	Size   int64           `json:"size,omitempty"`
+	Offset int64           `json:"offset"`
+	Window int64           `json:"window,omitempty"`
+	Chunk  int64           `json:"chunk,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+}
+
+// The size of the chunks the server sends, and the number of chunks
+// it buffers for every stream it receives.
+const (
+	streamChunkSize = 16 * 1024
+	streamChunks    = 8
+)
+
+// StreamHandler handles a stream sent by a connection.
+// ctx is cancelled when the connection closes. The stream is aborted if
+// the handler returns before reading it to the end, and a returned error is
+// sent back to the sender in the streamClose event, keeping the code of an *Error.
+type StreamHandler func(ctx context.Context, c *Conn, s *StreamReader) error
+
+// HandleStream registers handler for streams announced for event.
+// Streams are allowed for roles holding the stream:<event> permission.
+func (a *App) HandleStream(event string, handler StreamHandler) {
+	a.streamMu.Lock()
+	defer a.streamMu.Unlock()
+	if a.streamHandlers == nil {
+		a.streamHandlers = make(map[string]StreamHandler)
+	}
+	a.streamHandlers[event] = handler
+}
+
+// streamHandler returns the handler registered for event, if any.
+func (a *App) streamHandler(event string) (StreamHandler, bool) {
+	a.streamMu.RLock()
+	defer a.streamMu.RUnlock()
+	handler, ok := a.streamHandlers[event]
+	return handler, ok
+}
+
+// streams holds the streams of a connection: the ones it sends to
+// the server, read by a StreamReader, and the ones it receives,
+// written by a StreamWriter.
+type streams struct {
+	mu      sync.Mutex
+	readers map[string]*StreamReader
+	writers map[string]*StreamWriter
+}
+
+// newStreams creates an empty set of streams.
+// It returns the new set.
+func newStreams() *streams {
+	return &streams{
+		readers: make(map[string]*StreamReader),
+		writers: make(map[string]*StreamWriter),
+	}
+}
+
+// abort aborts every stream, as when their connection closes.
+func (s *streams) abort(err *Error) {
+	s.mu.Lock()
+	readers, writers := s.readers, s.writers
+	s.readers = make(map[string]*StreamReader)
+	s.writers = make(map[string]*StreamWriter)
+	s.mu.Unlock()
+	for _, r := range readers {
+		r.fail(err)
+	}
+	for _, w := range writers {
+		w.fail(err)
+	}
+}
+
+// StreamReader reads a stream sent by a connection.
+// ID, Event, Meta and Size are those announced by the sender;
+// Size is 0 if it was not announced.
+type StreamReader struct {
+	ID       string
+	Event    string
+	Meta     json.RawMessage
+	Size     int64
+	c        *Conn
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	received int64
+	read     int64
+	acked    int64
+	window   int64
+	end      int64
+	resuming bool
+	err      error
+}
+
+// Read reads the next bytes of the stream, acknowledging them to the
+// sender once half of the window has been consumed. It blocks until
+// the sender sends more bytes or closes the stream.
+// It returns the number of bytes read and io.EOF at the end of the stream,
+// or the error that aborted it.
+func (s *StreamReader) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 && s.err == nil && s.read != s.end {
+		s.cond.Wait()
+	}
+	if s.buf.Len() == 0 {
+		err := s.err
+		s.mu.Unlock()
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	n, _ := s.buf.Read(p)
+	s.read += int64(n)
+	ack := s.read == s.end || s.read-s.acked >= s.window/2
+	if ack {
+		s.acked = s.read
+	}
+	offset := s.read
+	s.mu.Unlock()
+	if ack {
+		s.c.sendStream("streamAck", &StreamMessage{Stream: s.ID, Offset: offset}, nil)
+	}
+	return n, nil
+}
+
+// done reports whether the stream was read to its end.
+func (s *StreamReader) done() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read == s.end
+}
+
+// push adds a chunk received at offset to the stream.
+// A chunk that does not start at the end of the bytes received so far is
+// dropped and answered, once, with a streamResume to that end.
+// It returns an error if the sender overruns the window.
+func (s *StreamReader) push(offset int64, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil || (s.end >= 0 && offset >= s.end) {
+		return nil
+	}
+	if offset != s.received {
+		if !s.resuming {
+			s.resuming = true
+			s.c.sendStream("streamResume", &StreamMessage{Stream: s.ID, Offset: s.received}, nil)
+		}
+		return nil
+	}
+	s.resuming = false
+	if s.received+int64(len(data))-s.read > s.window {
+		return NewError(ErrBadPayload.Code, "Stream window exceeded.")
+	}
+	s.buf.Write(data)
+	s.received += int64(len(data))
+	s.cond.Broadcast()
+	return nil
+}
+
+// close marks the end of the stream at offset, acknowledging it
+// if every byte has already been read.
+// It returns an error if bytes past offset were already received.
+func (s *StreamReader) close(offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if offset < s.received {
+		return NewError(ErrBadPayload.Code, "Stream closed before its last chunk.")
+	}
+	s.end = offset
+	if s.received < offset && !s.resuming {
+		s.resuming = true
+		s.c.sendStream("streamResume", &StreamMessage{Stream: s.ID, Offset: s.received}, nil)
+	}
+	if s.read == s.end && s.acked < s.end {
+		s.acked = s.end
+		s.c.sendStream("streamAck", &StreamMessage{Stream: s.ID, Offset: s.end}, nil)
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+// fail aborts the stream with err.
+func (s *StreamReader) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+// StreamWriter writes a stream to a connection.
+// ID is the id of the stream.
+type StreamWriter struct {
+	ID      string
+	c       *Conn
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	acked   int64
+	sent    int64
+	written int64
+	window  int64
+	chunk   int64
+	closed  bool
+	err     error
+}
+
+// OpenStream announces a stream to the connection for the listeners of event,
+// with optional metadata and the size of the stream, or 0 if it is unknown.
+// The stream is written with the returned StreamWriter, whose writes block
+// until the connection accepts the stream and while its window is full.
+// It returns the new stream writer or an error.
+func (c *Conn) OpenStream(event string, meta interface{}, size int64) (*StreamWriter, error) {
+	var raw json.RawMessage
+	if meta != nil {
+		var err error
+		if raw, err = json.Marshal(meta); err != nil {
+			return nil, err
+		}
+	}
+	w := &StreamWriter{
+		ID: uuid.New(),
+		c:  c,
+	}
+	w.cond = sync.NewCond(&w.mu)
+	c.streams.mu.Lock()
+	c.streams.writers[w.ID] = w
+	c.streams.mu.Unlock()
+	c.sendStream("streamOpen", &StreamMessage{
+		Stream: w.ID,
+		Event:  event,
+		Meta:   raw,
+		Size:   size,
+	}, nil)
+	return w, nil
+}
+
+// Write writes p to the stream in chunks.
+// It returns the number of bytes written and an error if the stream
+// was closed or aborted before all of p could be sent.
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n := 0
+	for len(p) > 0 {
+		for w.err == nil && (w.window == 0 || w.written-w.acked >= w.window) {
+			w.cond.Wait()
+		}
+		if w.err != nil {
+			return n, w.err
+		}
+		size := w.window - (w.written - w.acked)
+		if size > int64(len(p)) {
+			size = int64(len(p))
+		}
+		w.pending = append(w.pending, p[:size]...)
+		w.written += size
+		n += int(size)
+		p = p[size:]
+		w.flush()
+	}
+	return n, nil
+}
+
+// Close ends the stream and waits until the connection has accepted it
+// and acknowledged every byte written.
+// It returns the error that aborted the stream, if any.
+func (w *StreamWriter) Close() error {
+	w.mu.Lock()
+	if !w.closed && w.err == nil {
+		w.closed = true
+		w.c.sendStream("streamClose", &StreamMessage{Stream: w.ID, Offset: w.written}, nil)
+	}
+	for w.err == nil && (w.window == 0 || w.acked < w.written) {
+		w.cond.Wait()
+	}
+	err := w.err
+	w.mu.Unlock()
+	w.c.streams.mu.Lock()
+	delete(w.c.streams.writers, w.ID)
+	w.c.streams.mu.Unlock()
+	return err
+}
+
+// Abort aborts the stream, telling the connection why.
+func (w *StreamWriter) Abort(err error) {
+	e := AsError(err)
+	w.fail(e)
+	w.c.sendStream("streamClose", &StreamMessage{Stream: w.ID, Error: e}, nil)
+	w.c.streams.mu.Lock()
+	delete(w.c.streams.writers, w.ID)
+	w.c.streams.mu.Unlock()
+}
+
+// flush sends the bytes written but not yet sent.
+// It must be called with w.mu held.
+func (w *StreamWriter) flush() {
+	for w.sent < w.written {
+		size := w.written - w.sent
+		if size > w.chunk {
+			size = w.chunk
+		}
+		start := w.sent - w.acked
+		data := make([]byte, size)
+		copy(data, w.pending[start:start+size])
+		w.c.sendStream("streamChunk", &StreamMessage{Stream: w.ID, Offset: w.sent}, data)
+		w.sent += size
+	}
+}
+
+// ack records the bytes acknowledged by the connection, and the window
+// and chunk size it gives when accepting the stream.
+func (w *StreamWriter) ack(data *StreamMessage) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if data.Offset < w.acked || data.Offset > w.sent {
+		return
+	}
+	if data.Window > 0 {
+		w.window = data.Window
+		w.chunk = streamChunkSize
+		if data.Chunk > 0 && data.Chunk < w.chunk {
+			w.chunk = data.Chunk
+		}
+	}
+	w.pending = w.pending[data.Offset-w.acked:]
+	w.acked = data.Offset
+	w.cond.Broadcast()
+}
+
+// resume sends the stream again from offset, which must not
+// precede the last acknowledged offset.
+func (w *StreamWriter) resume(offset int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	if offset < w.acked || offset > w.sent {
+		w.err = NewError(ErrBadPayload.Code, "Cannot resume the stream at this offset.")
+		w.cond.Broadcast()
+		return
+	}
+	w.sent = offset
+	w.flush()
+}
+
+// fail aborts the stream with err.
+func (w *StreamWriter) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.cond.Broadcast()
+}
+
+// sendStream sends a message of the streaming protocol to this connection.
+// Streams are flow controlled by their window, so their messages are never
+// dropped by the overflow policy of the connection.
+func (c *Conn) sendStream(event string, payload *StreamMessage, data []byte) {
+	c.out.push(&Message{
+		Room:    "root",
+		Event:   event,
+		Payload: rawPayload(payload),
+		Data:    data,
+	}, true)
+}
+
+// HandleStreamData handles a message of the streaming protocol.
+// It returns an error if any occur.
+func (c *Conn) HandleStreamData(data *Message) error {
+	payload := &StreamMessage{}
+	if err := data.Decode(payload); err != nil {
+		return err
+	}
+	c.streams.mu.Lock()
+	r := c.streams.readers[payload.Stream]
+	w := c.streams.writers[payload.Stream]
+	c.streams.mu.Unlock()
+	switch data.Event {
+	case "streamOpen":
+		return c.acceptStream(payload)
+	case "streamChunk":
+		if r == nil {
+			return nil
+		}
+		if err := r.push(payload.Offset, data.Data); err != nil {
+			c.abortStream(r, err)
+		}
+	case "streamAck":
+		if w != nil {
+			w.ack(payload)
+		}
+	case "streamResume":
+		if w != nil {
+			w.resume(payload.Offset)
+		}
+	case "streamClose":
+		if r != nil {
+			if payload.Error != nil {
+				c.dropStream(r)
+				r.fail(payload.Error)
+			} else if err := r.close(payload.Offset); err != nil {
+				c.abortStream(r, err)
+			}
+		} else if w != nil {
+			c.streams.mu.Lock()
+			delete(c.streams.writers, w.ID)
+			c.streams.mu.Unlock()
+			if payload.Error != nil {
+				w.fail(payload.Error)
+			} else {
+				w.fail(ErrStreamAborted)
+			}
+		}
+	}
+	return nil
+}
+
+// acceptStream starts the handler registered for a stream announced by
+// the connection, or refuses the stream if there is none, the
+// connection's role lacks the stream:<event> permission or the
+// connection already sends as many streams as its limits allow.
+// It returns an error if any occur.
+func (c *Conn) acceptStream(payload *StreamMessage) error {
+	handler, ok := c.app.streamHandler(payload.Event)
+	refuse := func(err *Error) error {
+		c.sendStream("streamClose", &StreamMessage{Stream: payload.Stream, Error: err}, nil)
+		return nil
+	}
+	if !ok {
+		return refuse(ErrStreamRefused)
+	}
+	if !c.Can("stream:" + payload.Event) {
+		return refuse(ErrPermissionDenied)
+	}
+	chunk := (c.limits.ReadLimit - 512) * 3 / 4
+	if chunk < 1 {
+		chunk = 1
+	}
+	r := &StreamReader{
+		ID:     payload.Stream,
+		Event:  payload.Event,
+		Meta:   payload.Meta,
+		Size:   payload.Size,
+		c:      c,
+		window: chunk * streamChunks,
+		end:    -1,
+	}
+	r.cond = sync.NewCond(&r.mu)
+	c.streams.mu.Lock()
+	_, dup := c.streams.readers[r.ID]
+	full := len(c.streams.readers) >= c.limits.Streams
+	if !dup && !full {
+		c.streams.readers[r.ID] = r
+	}
+	c.streams.mu.Unlock()
+	if dup {
+		return refuse(ErrStreamRefused)
+	}
+	if full {
+		return refuse(ErrTooManyStreams)
+	}
+	c.sendStream("streamAck", &StreamMessage{Stream: r.ID, Window: r.window, Chunk: chunk}, nil)
+	go func() {
+		err := handler(c.ctx, c, r)
+		if err == nil && r.done() {
+			c.dropStream(r)
+			return
+		}
+		if err == nil {
+			err = ErrStreamAborted
+		}
+		log.Println("stream", r.ID, "aborted:", err)
+		c.abortStream(r, err)
+	}()
+	return nil
+}
+
+// abortStream aborts a stream received from the connection,
+// telling it why unless the stream was already dropped.
+func (c *Conn) abortStream(r *StreamReader, err error) {
+	e := AsError(err)
+	r.fail(e)
+	if c.dropStream(r) {
+		c.sendStream("streamClose", &StreamMessage{Stream: r.ID, Error: e}, nil)
+	}
+}
+
+// dropStream forgets a stream received from the connection.
+// It reports whether the stream was still known.
+func (c *Conn) dropStream(r *StreamReader) bool {
+	c.streams.mu.Lock()
+	defer c.streams.mu.Unlock()
+	if c.streams.readers[r.ID] != r {
+		return false
+	}
+	delete(c.streams.readers, r.ID)
+	return true
+}
@@ -0,0 +1,60 @@
+//    Title: stream_test.go
+//    Author: JD
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestStreamLimit(t *testing.T) {
+	app := newTestApp(t, `, "limits": {"default": {"streams": "2"}}`)
+	block := make(chan struct{})
+	defer close(block)
+	app.HandleStream("upload", func(ctx context.Context, c *Conn, r *StreamReader) error {
+		<-block
+		return nil
+	})
+	ws := dialTestApp(t, app)
+	readUntil(t, ws, "join")
+	for i := 1; i <= 3; i++ {
+		payload, _ := json.Marshal(&StreamMessage{Stream: fmt.Sprint(i), Event: "upload"})
+		if err := ws.WriteJSON(&Message{Room: "root", Event: "streamOpen", Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		var reply *Message
+		if i < 3 {
+			reply = readUntil(t, ws, "streamAck")
+		} else {
+			reply = readUntil(t, ws, "streamClose")
+		}
+		payload := &StreamMessage{}
+		if err := json.Unmarshal(reply.Payload, payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Stream != fmt.Sprint(i) {
+			t.Fatalf("got %s for stream %d", reply.Payload, i)
+		}
+		if i == 3 && (payload.Error == nil || payload.Error.Code != ErrTooManyStreams.Code) {
+			t.Errorf("third stream not refused: %s", reply.Payload)
+		}
+	}
+}